@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,29 +33,66 @@ const (
 
 // 消息类型
 type Message struct {
+	ID      string `json:"id,omitempty"`
 	From    string `json:"from"`
 	Content string `json:"content"`
+	Type    string `json:"type,omitempty"`   // 为event时表示临时事件，为receipt时表示回执，为session时表示会话信息
+	Stream  string `json:"stream,omitempty"` // 流式AI回复帧：chunk/done/cancelled
+	Event   string `json:"event,omitempty"`  // 临时事件：typing/stopped_typing/online/away/focus/blur
+
+	ClientID string `json:"client_id,omitempty"` // 发送时生成的临时ID，sent回执中原样返回
+	Receipt  string `json:"receipt,omitempty"`   // 回执状态：sent/delivered/read
 }
 
-// 匹配请求
-type MatchRequest struct {
+// 匿名登录结果
+type AuthSession struct {
+	Token  string `json:"token"`
 	UserID string `json:"user_id"`
 }
 
-// 匹配响应
-type MatchResponse struct {
-	Matched   bool   `json:"matched"`
-	RoomID    string `json:"room_id"`
-	PartnerID string `json:"partner_id"`
+// AI人设
+type Persona struct {
+	Name   string `json:"name"`
+	Avatar string `json:"avatar"`
+}
+
+// 匹配票据
+type MatchTicket struct {
+	TicketID  string   `json:"ticket_id"`
+	Status    string   `json:"status"` // queued/matched/cancelled/failed
+	Matched   bool     `json:"matched"`
+	RoomID    string   `json:"room_id"`
+	PartnerID string   `json:"partner_id"`
+	Persona   *Persona `json:"persona"` // 与AI匹配时的AI人设
+}
+
+// 匹配生命周期事件
+type MatchEvent struct {
+	Type      string   `json:"type"` // queued/position/matched/ai_matched/cancelled
+	Position  int      `json:"position"`
+	RoomID    string   `json:"room_id"`
+	PartnerID string   `json:"partner_id"`
+	Persona   *Persona `json:"persona"`
 }
 
 // 自定义消息类型
 type matchSuccessMsg struct {
 	roomID    string
 	partnerID string
+	persona   *Persona
 }
 
+type loginMsg AuthSession
+type authFailMsg struct{}
 type matchFailMsg struct{}
+type matchPendingMsg struct {
+	ticketID string
+}
+type lobbyConnectedMsg struct {
+	body io.ReadCloser
+}
+type lobbyEventMsg MatchEvent
+type lobbyClosedMsg struct{}
 type messageReceivedMsg Message
 type wsConnectedMsg struct {
 	conn *websocket.Conn
@@ -64,19 +103,28 @@ type wsErrorMsg struct {
 
 // 主模型
 type model struct {
-	state        AppState
-	userID       string
-	roomID       string
-	partnerID    string
-	conn         *websocket.Conn
-	messages     []Message
-	input        textinput.Model
-	viewport     viewport.Model
-	menuChoice   int
-	matchRetries int
-	ready        bool
-	width        int
-	height       int
+	state         AppState
+	name          string // 登录时使用的用户名
+	userID        string // 服务端生成的用户ID，登录前与用户名相同
+	token         string // 匿名登录获得的令牌
+	roomID        string
+	partnerID     string
+	partnerTyping bool // 对方正在输入
+	partnerAway   bool // 对方暂时离开
+	typing        bool // 已通知对方自己正在输入
+	conn          *websocket.Conn
+	messages      []Message
+	input         textinput.Model
+	viewport      viewport.Model
+	menuChoice    int
+	matchRetries  int
+	ticketID      string // 进行中的匹配票据
+	position      int    // 排队位置
+	lobby         io.ReadCloser
+	lobbyReader   *bufio.Reader
+	ready         bool
+	width         int
+	height        int
 }
 
 // 样式定义
@@ -123,9 +171,11 @@ func initialModel() model {
 	vp := viewport.New(78, 20)
 	vp.YPosition = 1
 
+	name := fmt.Sprintf("user_%d", time.Now().Unix())
 	return model{
 		state:      StateMenu,
-		userID:     fmt.Sprintf("user_%d", time.Now().Unix()),
+		name:       name,
+		userID:     name,
 		input:      ti,
 		viewport:   vp,
 		menuChoice: 0,
@@ -163,17 +213,83 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case matchSuccessMsg:
+		m.ticketID = ""
+		m.position = 0
 		m.roomID = msg.roomID
 		m.partnerID = msg.partnerID
+		m.partnerTyping = false
+		m.partnerAway = false
+		m.typing = false
+		if msg.persona != nil {
+			// 与AI匹配时显示AI人设
+			m.partnerID = fmt.Sprintf("%s %s", msg.persona.Avatar, msg.persona.Name)
+		}
 		m.state = StateChatting
 		m.input.Focus() // 激活输入框焦点
 		m.messages = []Message{
-			{From: "系统", Content: fmt.Sprintf("成功匹配到聊天伙伴: %s", msg.partnerID)},
+			{From: "系统", Content: fmt.Sprintf("成功匹配到聊天伙伴: %s", m.partnerID)},
 		}
 		m.updateViewport()
 		return m, m.connectWebSocket
 
+	case matchPendingMsg:
+		// 已返回菜单时不再等待
+		if m.state != StateMatching {
+			return m, nil
+		}
+		m.ticketID = msg.ticketID
+		if m.lobby != nil {
+			return m, nil
+		}
+		return m, m.connectLobby
+
+	case lobbyConnectedMsg:
+		if m.state != StateMatching {
+			msg.body.Close()
+			return m, nil
+		}
+		m.lobby = msg.body
+		m.lobbyReader = bufio.NewReader(msg.body)
+		return m, m.listenForLobbyEvents
+
+	case lobbyEventMsg:
+		switch msg.Type {
+		case "queued", "position":
+			m.position = msg.Position
+			return m, m.listenForLobbyEvents
+		case "matched", "ai_matched":
+			m.closeLobby()
+			return m.Update(matchSuccessMsg{roomID: msg.RoomID, partnerID: msg.PartnerID, persona: msg.Persona})
+		case "cancelled":
+			m.closeLobby()
+			return m.Update(matchFailMsg{})
+		}
+		return m, m.listenForLobbyEvents
+
+	case lobbyClosedMsg:
+		// 事件流中断时重新匹配，主动关闭（返回菜单）时忽略
+		if m.lobby == nil || m.state != StateMatching {
+			return m, nil
+		}
+		m.closeLobby()
+		return m.Update(matchFailMsg{})
+
+	case loginMsg:
+		m.token = msg.Token
+		m.userID = msg.UserID
+		if m.state != StateMatching {
+			return m, nil
+		}
+		return m, m.requestMatch
+
+	case authFailMsg:
+		// 令牌无效或过期，重新登录
+		m.token = ""
+		return m.Update(matchFailMsg{})
+
 	case matchFailMsg:
+		m.ticketID = ""
+		m.position = 0
 		m.matchRetries++
 		if m.matchRetries >= 30 {
 			m.state = StateMenu
@@ -186,6 +302,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			)
 		}
 		return m, tea.Tick(time.Second, func(t time.Time) tea.Msg {
+			if m.token == "" {
+				return m.login()
+			}
 			return m.requestMatch()
 		})
 
@@ -203,7 +322,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case messageReceivedMsg:
-		m.messages = append(m.messages, Message(msg))
+		m.addMessage(Message(msg))
 		m.updateViewport()
 		// 继续监听下一条消息
 		if m.state == StateChatting && m.conn != nil {
@@ -283,7 +402,11 @@ func (m model) viewMatching() string {
 	s += "\n"
 	s += systemStyle.Render(fmt.Sprintf("匹配尝试次数: %d/30", m.matchRetries))
 	s += "\n\n"
-	s += messageStyle.Render("正在寻找聊天伙伴，请稍候...")
+	if m.position > 0 {
+		s += messageStyle.Render(fmt.Sprintf("正在寻找聊天伙伴，当前排队第 %d 位...", m.position))
+	} else {
+		s += messageStyle.Render("正在寻找聊天伙伴，请稍候...")
+	}
 	s += "\n\n"
 	s += menuStyle.Render("按 'q' 或 ESC 返回主菜单")
 
@@ -294,6 +417,11 @@ func (m model) viewChatting() string {
 	s := titleStyle.Render(fmt.Sprintf("💬 聊天室: %s", m.roomID))
 	s += "\n"
 	s += systemStyle.Render(fmt.Sprintf("聊天伙伴: %s", m.partnerID))
+	if m.partnerTyping {
+		s += systemStyle.Render(" · 正在输入...")
+	} else if m.partnerAway {
+		s += systemStyle.Render(" · 暂时离开")
+	}
 	s += "\n\n"
 
 	// 显示聊天记录
@@ -339,6 +467,8 @@ func (m model) viewHelp() string {
 	s += "\n"
 	s += normalStyle.Render("• 匹配接口: POST http://127.0.0.1:9093/api/match")
 	s += "\n"
+	s += normalStyle.Render("• 匹配事件: GET http://127.0.0.1:9093/api/lobby/events")
+	s += "\n"
 	s += normalStyle.Render("• WebSocket: ws://127.0.0.1:9093/api/ws")
 	s += "\n\n"
 	s += menuStyle.Render("按任意键返回主菜单")
@@ -364,9 +494,10 @@ func (m model) handleMenuKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		case 0: // 开始匹配
 			m.state = StateMatching
 			m.matchRetries = 0
-			return m, func() tea.Msg {
-				return m.requestMatch()
+			if m.token == "" {
+				return m, m.login
 			}
+			return m, m.requestMatch
 		case 1: // 退出程序
 			return m, tea.Quit
 		case 2: // 帮助信息
@@ -382,6 +513,16 @@ func (m model) handleMatchingKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "ctrl+c", "q", "esc":
 		m.state = StateMenu
 		m.matchRetries = 0
+		m.position = 0
+		m.closeLobby()
+		if m.ticketID != "" {
+			ticketID, token := m.ticketID, m.token
+			m.ticketID = ""
+			return m, func() tea.Msg {
+				cancelMatch(ticketID, token)
+				return nil
+			}
+		}
 	}
 	return m, nil
 }
@@ -392,10 +533,7 @@ func (m model) handleChattingKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "ctrl+c":
 		return m, tea.Quit
 	case "esc":
-		if m.conn != nil {
-			m.conn.Close()
-			m.conn = nil
-		}
+		m.closeConn()
 		m.state = StateMenu
 		m.input.SetValue("")
 		m.input.Blur() // 取消输入框焦点
@@ -414,10 +552,7 @@ func (m model) handleChattingKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 				m.updateViewport()
 
 				// 关闭WebSocket连接
-				if m.conn != nil {
-					m.conn.Close()
-					m.conn = nil
-				}
+				m.closeConn()
 				m.state = StateMenu
 				m.input.SetValue("")
 				m.input.Blur() // 取消输入框焦点
@@ -425,8 +560,10 @@ func (m model) handleChattingKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			}
 
 			message := Message{
-				From:    m.userID,
-				Content: inputContent,
+				From:     m.userID,
+				Content:  inputContent,
+				Type:     "text",
+				ClientID: strconv.FormatInt(time.Now().UnixNano(), 36),
 			}
 
 			// 发送消息
@@ -441,6 +578,7 @@ func (m model) handleChattingKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 				m.messages = append(m.messages, message)
 			}
 			m.input.SetValue("")
+			m.updateTyping()
 			m.updateViewport()
 		}
 		return m, nil
@@ -448,10 +586,51 @@ func (m model) handleChattingKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		// 对于其他所有按键，让输入框处理
 		var cmd tea.Cmd
 		m.input, cmd = m.input.Update(msg)
+		m.updateTyping()
 		return m, cmd
 	}
 }
 
+// 输入框有内容时通知对方正在输入，清空或发送后通知停止输入
+func (m *model) updateTyping() {
+	typing := strings.TrimSpace(m.input.Value()) != ""
+	if typing == m.typing {
+		return
+	}
+	m.typing = typing
+	if typing {
+		m.sendEvent("typing")
+	} else {
+		m.sendEvent("stopped_typing")
+	}
+}
+
+// 发送临时事件，不会保存到聊天记录
+func (m *model) sendEvent(event string) {
+	if m.conn == nil {
+		return
+	}
+	m.conn.WriteJSON(Message{Type: "event", Event: event})
+}
+
+// 关闭WebSocket连接，发送关闭帧告知服务端主动离开房间（不保留断线重连的位置）
+func (m *model) closeConn() {
+	if m.conn == nil {
+		return
+	}
+	m.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	m.conn.Close()
+	m.conn = nil
+}
+
+// 发送消息回执，终端界面收到即视为已读
+func (m *model) sendReceipt(id, receipt string) {
+	if m.conn == nil {
+		return
+	}
+	m.conn.WriteJSON(Message{ID: id, Type: "receipt", Receipt: receipt})
+}
+
 // 处理帮助页面按键
 func (m model) handleHelpKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.String() {
@@ -463,32 +642,135 @@ func (m model) handleHelpKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
-// 请求匹配
+// 匿名登录，获取令牌和服务端生成的用户ID
+func (m model) login() tea.Msg {
+	reqBody, _ := json.Marshal(map[string]string{"name": m.name})
+
+	resp, err := http.Post("http://127.0.0.1:9093/api/auth/anonymous", "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return matchFailMsg{}
+	}
+	defer resp.Body.Close()
+
+	var session AuthSession
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&session) != nil {
+		return matchFailMsg{}
+	}
+	return loginMsg(session)
+}
+
+// 请求匹配，服务端立即返回匹配票据
 func (m model) requestMatch() tea.Msg {
-	req := MatchRequest{UserID: m.userID}
-	reqBody, _ := json.Marshal(req)
+	// 用户ID由令牌决定，请求体中不需要携带
+	httpReq, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:9093/api/match", bytes.NewBufferString("{}"))
+	if err != nil {
+		return matchFailMsg{}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+m.token)
 
-	resp, err := http.Post("http://127.0.0.1:9093/api/match", "application/json", bytes.NewBuffer(reqBody))
+	resp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		return matchFailMsg{}
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return authFailMsg{}
+	}
+
+	return readTicket(resp)
+}
+
+// 连接大厅事件流，等待匹配结果推送
+func (m model) connectLobby() tea.Msg {
+	u := url.URL{Scheme: "http", Host: "127.0.0.1:9093", Path: "/api/lobby/events"}
+	q := u.Query()
+	q.Set("token", m.token)
+	u.RawQuery = q.Encode()
 
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return matchFailMsg{}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return matchFailMsg{}
+	}
+
+	return lobbyConnectedMsg{body: resp.Body}
+}
+
+// 读取下一条大厅事件（SSE格式：event/data行，空行结束）
+func (m model) listenForLobbyEvents() tea.Msg {
+	if m.lobbyReader == nil {
+		return lobbyClosedMsg{}
+	}
+
+	var event MatchEvent
+	var data string
+	for {
+		line, err := m.lobbyReader.ReadString('\n')
+		if err != nil {
+			return lobbyClosedMsg{}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimPrefix(line, "data:")
+		case line == "" && data != "":
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				data = ""
+				continue
+			}
+			return lobbyEventMsg(event)
+		}
+	}
+}
+
+// 关闭大厅事件流
+func (m *model) closeLobby() {
+	if m.lobby != nil {
+		m.lobby.Close()
+		m.lobby = nil
+		m.lobbyReader = nil
+	}
+}
+
+// 取消匹配票据
+func cancelMatch(ticketID, token string) {
+	req, err := http.NewRequest(http.MethodDelete, "http://127.0.0.1:9093/api/match/"+url.PathEscape(ticketID), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// 解析匹配票据
+func readTicket(resp *http.Response) tea.Msg {
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return matchFailMsg{}
 	}
 
-	var matchResp MatchResponse
-	if err := json.Unmarshal(body, &matchResp); err != nil {
+	var ticket MatchTicket
+	if err := json.Unmarshal(body, &ticket); err != nil {
 		return matchFailMsg{}
 	}
 
-	if matchResp.Matched {
+	switch ticket.Status {
+	case "matched":
 		return matchSuccessMsg{
-			roomID:    matchResp.RoomID,
-			partnerID: matchResp.PartnerID,
+			roomID:    ticket.RoomID,
+			partnerID: ticket.PartnerID,
+			persona:   ticket.Persona,
 		}
+	case "queued":
+		return matchPendingMsg{ticketID: ticket.TicketID}
 	}
 
 	return matchFailMsg{}
@@ -499,7 +781,7 @@ func (m model) connectWebSocket() tea.Msg {
 	u := url.URL{Scheme: "ws", Host: "127.0.0.1:9093", Path: "/api/ws"}
 	q := u.Query()
 	q.Set("room", m.roomID)
-	q.Set("user", m.userID)
+	q.Set("token", m.token)
 	u.RawQuery = q.Encode()
 
 	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
@@ -526,6 +808,91 @@ func (m model) listenForMessages() tea.Msg {
 	return messageReceivedMsg(message)
 }
 
+// 添加收到的消息，流式AI回复的各帧合并为同一条消息，临时事件只更新对方状态，回执更新自己消息的状态
+func (m *model) addMessage(msg Message) {
+	// 会话信息只在恢复失败时提示
+	if msg.Type == "session" {
+		if msg.Content != "" {
+			m.messages = append(m.messages, Message{From: "系统", Content: msg.Content})
+		}
+		return
+	}
+	if msg.Type == "receipt" {
+		for i := len(m.messages) - 1; i >= 0; i-- {
+			own := &m.messages[i]
+			if own.From != m.userID {
+				continue
+			}
+			if msg.Receipt == "sent" && own.ClientID == msg.ClientID {
+				own.ID = msg.ID
+				own.Receipt = msg.Receipt
+				return
+			}
+			if msg.Receipt != "sent" && own.ID != "" && own.ID == msg.ID {
+				if own.Receipt != "read" {
+					own.Receipt = msg.Receipt
+				}
+				return
+			}
+		}
+		return
+	}
+	// 对方的完整消息回执送达和已读
+	if msg.ID != "" && msg.From != m.userID && msg.From != "system" && (msg.Stream == "" || msg.Stream == "done") {
+		m.sendReceipt(msg.ID, "delivered")
+		m.sendReceipt(msg.ID, "read")
+	}
+	if msg.Type == "event" {
+		switch msg.Event {
+		case "typing":
+			m.partnerTyping = true
+		case "stopped_typing":
+			m.partnerTyping = false
+		case "away":
+			m.partnerAway = true
+			m.partnerTyping = false
+		case "online", "focus":
+			m.partnerAway = false
+		}
+		return
+	}
+	if msg.Stream != "" {
+		for i := len(m.messages) - 1; i >= 0; i-- {
+			if m.messages[i].ID != msg.ID {
+				continue
+			}
+			switch msg.Stream {
+			case "done":
+				// 结束帧携带完整内容
+				m.messages[i].Content = msg.Content
+			case "cancelled":
+				// 回复被取消，移除已收到的部分内容
+				m.messages = append(m.messages[:i], m.messages[i+1:]...)
+			default:
+				m.messages[i].Content += msg.Content
+			}
+			return
+		}
+		if msg.Stream == "cancelled" {
+			return
+		}
+	}
+	m.messages = append(m.messages, msg)
+}
+
+// 自己消息的回执状态
+func receiptLabel(receipt string) string {
+	switch receipt {
+	case "sent":
+		return " ✓"
+	case "delivered":
+		return " ✓✓"
+	case "read":
+		return " 已读"
+	}
+	return ""
+}
+
 // 更新视口内容
 func (m *model) updateViewport() {
 	var content strings.Builder
@@ -533,7 +900,7 @@ func (m *model) updateViewport() {
 		if msg.From == "系统" {
 			content.WriteString(systemStyle.Render(fmt.Sprintf("[%s] %s", msg.From, msg.Content)))
 		} else if msg.From == m.userID {
-			content.WriteString(messageStyle.Render(fmt.Sprintf("[我] %s", msg.Content)))
+			content.WriteString(messageStyle.Render(fmt.Sprintf("[我] %s%s", msg.Content, receiptLabel(msg.Receipt))))
 		} else {
 			content.WriteString(messageStyle.Render(fmt.Sprintf("[%s] %s", msg.From, msg.Content)))
 		}
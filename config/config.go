@@ -0,0 +1,412 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/toujourser/chat-matcher/handler"
+	"gopkg.in/yaml.v3"
+)
+
+// Config 服务器配置，按 默认值 -> 配置文件 -> 环境变量 -> 命令行参数 的顺序覆盖
+type Config struct {
+	Server  ServerConfig  `yaml:"server"`
+	Auth    AuthConfig    `yaml:"auth"`
+	Redis   RedisConfig   `yaml:"redis"`
+	Storage StorageConfig `yaml:"storage"`
+	Match   MatchConfig   `yaml:"match"`
+	Room    RoomConfig    `yaml:"room"`
+	AI      AIConfig      `yaml:"ai"`
+
+	fallback *handler.AIFallbackPolicy // Load时根据Match生成的AI匹配策略
+	personas *handler.PersonaRegistry  // Load时根据AI加载的人设
+}
+
+// ServerConfig HTTP服务配置
+type ServerConfig struct {
+	Addr      string `yaml:"addr"`       // 监听地址
+	LogDir    string `yaml:"log_dir"`    // 日志目录
+	StaticDir string `yaml:"static_dir"` // 静态文件目录
+}
+
+// AuthConfig 用户令牌配置
+type AuthConfig struct {
+	Secret   string        `yaml:"secret"`    // 令牌签名密钥，多实例部署时需相同；为空时每次启动随机生成
+	AdminKey string        `yaml:"admin_key"` // 换取管理员令牌的密钥，为空时禁用管理员登录
+	TokenTTL time.Duration `yaml:"token_ttl"` // 令牌有效期
+}
+
+// RedisConfig Redis连接配置
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// StorageConfig 存储配置
+type StorageConfig struct {
+	Type              string        `yaml:"type"`                // redis/memory/sqlite
+	SQLiteDSN         string        `yaml:"sqlite_dsn"`          // SQLite数据源，为空时使用 data/chat-matcher.db（启用WAL和busy_timeout）
+	MemoryMaxMessages int           `yaml:"memory_max_messages"` // 内存存储每个房间保留的消息数
+	HistoryTTL        time.Duration `yaml:"history_ttl"`         // Redis中聊天记录的保留时间
+}
+
+// MatchConfig 匹配配置
+type MatchConfig struct {
+	Queue           string        `yaml:"queue"`             // memory/redis
+	AIFallback      string        `yaml:"ai_fallback"`       // on/off/opt-in
+	AIFallbackWait  time.Duration `yaml:"ai_fallback_wait"`  // 与AI匹配前等待真人的时间
+	MaxWait         time.Duration `yaml:"max_wait"`          // 等待真人的最长时间
+	AIFallbackHours string        `yaml:"ai_fallback_hours"` // 允许与AI匹配的时段，如 22-6,12-14
+}
+
+// RoomConfig 房间配置
+type RoomConfig struct {
+	Transport       string        `yaml:"transport"`         // local/redis
+	AIGreetingDelay time.Duration `yaml:"ai_greeting_delay"` // AI打招呼前的等待时间
+	AIReplyTimeout  time.Duration `yaml:"ai_reply_timeout"`  // 单次AI回复的超时时间
+	DedupeWindow    time.Duration `yaml:"dedupe_window"`     // 相同客户端消息ID只保存一次的时间窗口
+	ResumeGrace     time.Duration `yaml:"resume_grace"`      // 连接意外断开后保留用户位置的时间，为0时断线即离开房间
+}
+
+// AIConfig AI模型配置
+type AIConfig struct {
+	Provider string   `yaml:"provider"` // openai/ollama/scripted
+	APIKey   string   `yaml:"api_key"`
+	Model    string   `yaml:"model"`    // 为空时使用提供方的默认模型
+	BaseURL  string   `yaml:"base_url"` // 为空时使用提供方的默认地址
+	Script   []string `yaml:"script"`   // scripted提供方的预设回复
+
+	ContextBudget    int `yaml:"context_budget"`    // 对话上下文的token预算，为0时按模型使用默认值
+	SummaryThreshold int `yaml:"summary_threshold"` // 未概括的消息超过该数量时生成对话摘要
+
+	PersonaDir     string `yaml:"persona_dir"`     // AI人设目录，每个YAML文件一个人设
+	DefaultPersona string `yaml:"default_persona"` // 未指定偏好时使用的人设
+}
+
+// Default 返回默认配置
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:      ":9093",
+			LogDir:    "logs",
+			StaticDir: "./static",
+		},
+		Auth: AuthConfig{
+			TokenTTL: 24 * time.Hour,
+		},
+		Redis: RedisConfig{
+			Addr: "localhost:6379",
+		},
+		Storage: StorageConfig{
+			Type:              "redis",
+			MemoryMaxMessages: 1000,
+			HistoryTTL:        30 * 24 * time.Hour,
+		},
+		Match: MatchConfig{
+			Queue:          "memory",
+			AIFallback:     "on",
+			AIFallbackWait: 10 * time.Second,
+			MaxWait:        5 * time.Minute,
+		},
+		Room: RoomConfig{
+			Transport:       "local",
+			AIGreetingDelay: 500 * time.Millisecond,
+			AIReplyTimeout:  60 * time.Second,
+			DedupeWindow:    5 * time.Minute,
+			ResumeGrace:     30 * time.Second,
+		},
+		AI: AIConfig{
+			Provider:         handler.ProviderOpenAI,
+			DefaultPersona:   handler.DefaultPersonaName,
+			SummaryThreshold: 30,
+		},
+	}
+}
+
+// Load 加载配置：配置文件由 -config 参数或 CONFIG_FILE 环境变量指定
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	path := os.Getenv("CONFIG_FILE")
+
+	fs := flag.NewFlagSet("chat-matcher", flag.ContinueOnError)
+	fs.StringVar(&path, "config", path, "配置文件路径（YAML）")
+	cfg.bindFlags(fs)
+
+	// 先解析一次获取配置文件路径，加载文件和环境变量后再解析一次，使命令行参数优先
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// 校验通过后生成AI匹配策略并加载AI人设
+	var err error
+	if cfg.fallback, err = cfg.Match.fallbackPolicy(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if cfg.personas, err = cfg.AI.personas(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// bindFlags 注册命令行参数
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Server.Addr, "addr", c.Server.Addr, "HTTP监听地址")
+	fs.StringVar(&c.Server.LogDir, "log-dir", c.Server.LogDir, "日志目录")
+	fs.StringVar(&c.Server.StaticDir, "static-dir", c.Server.StaticDir, "静态文件目录")
+
+	fs.DurationVar(&c.Auth.TokenTTL, "auth-token-ttl", c.Auth.TokenTTL, "用户令牌有效期")
+
+	fs.StringVar(&c.Redis.Addr, "redis-addr", c.Redis.Addr, "Redis地址")
+	fs.IntVar(&c.Redis.DB, "redis-db", c.Redis.DB, "Redis数据库")
+
+	fs.StringVar(&c.Storage.Type, "storage", c.Storage.Type, "存储类型：redis/memory/sqlite")
+	fs.StringVar(&c.Storage.SQLiteDSN, "sqlite-dsn", c.Storage.SQLiteDSN, "SQLite数据源")
+	fs.IntVar(&c.Storage.MemoryMaxMessages, "memory-max-messages", c.Storage.MemoryMaxMessages, "内存存储每个房间保留的消息数")
+	fs.DurationVar(&c.Storage.HistoryTTL, "history-ttl", c.Storage.HistoryTTL, "Redis中聊天记录的保留时间")
+
+	fs.StringVar(&c.Match.Queue, "match-queue", c.Match.Queue, "匹配队列：memory/redis")
+	fs.StringVar(&c.Match.AIFallback, "ai-fallback", c.Match.AIFallback, "AI匹配：on/off/opt-in")
+	fs.DurationVar(&c.Match.AIFallbackWait, "ai-fallback-wait", c.Match.AIFallbackWait, "与AI匹配前等待真人的时间")
+	fs.DurationVar(&c.Match.MaxWait, "max-wait", c.Match.MaxWait, "等待真人的最长时间")
+	fs.StringVar(&c.Match.AIFallbackHours, "ai-fallback-hours", c.Match.AIFallbackHours, "允许与AI匹配的时段，如 22-6,12-14")
+
+	fs.StringVar(&c.Room.Transport, "room-transport", c.Room.Transport, "房间消息传输层：local/redis")
+	fs.DurationVar(&c.Room.AIGreetingDelay, "ai-greeting-delay", c.Room.AIGreetingDelay, "AI打招呼前的等待时间")
+	fs.DurationVar(&c.Room.AIReplyTimeout, "ai-reply-timeout", c.Room.AIReplyTimeout, "单次AI回复的超时时间")
+	fs.DurationVar(&c.Room.DedupeWindow, "dedupe-window", c.Room.DedupeWindow, "相同客户端消息ID只保存一次的时间窗口")
+	fs.DurationVar(&c.Room.ResumeGrace, "resume-grace", c.Room.ResumeGrace, "连接意外断开后保留用户位置的时间，为0时断线即离开房间")
+
+	fs.StringVar(&c.AI.Provider, "ai-provider", c.AI.Provider, "AI提供方：openai/ollama/scripted")
+	fs.StringVar(&c.AI.Model, "ai-model", c.AI.Model, "AI模型")
+	fs.StringVar(&c.AI.BaseURL, "ai-base-url", c.AI.BaseURL, "AI接口地址")
+	fs.IntVar(&c.AI.ContextBudget, "ai-context-budget", c.AI.ContextBudget, "对话上下文的token预算，为0时按模型使用默认值")
+	fs.IntVar(&c.AI.SummaryThreshold, "ai-summary-threshold", c.AI.SummaryThreshold, "未概括的消息超过该数量时生成对话摘要")
+	fs.StringVar(&c.AI.PersonaDir, "persona-dir", c.AI.PersonaDir, "AI人设目录")
+	fs.StringVar(&c.AI.DefaultPersona, "default-persona", c.AI.DefaultPersona, "默认AI人设")
+}
+
+// loadFile 从YAML文件加载配置，文件中未出现的字段保持原值
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv 从环境变量加载配置
+func (c *Config) loadEnv() error {
+	stringVars := map[string]*string{
+		"SERVER_ADDR":        &c.Server.Addr,
+		"LOG_DIR":            &c.Server.LogDir,
+		"STATIC_DIR":         &c.Server.StaticDir,
+		"AUTH_ADMIN_KEY":     &c.Auth.AdminKey,
+		"AUTH_SECRET":        &c.Auth.Secret,
+		"REDIS_ADDR":         &c.Redis.Addr,
+		"REDIS_PASSWORD":     &c.Redis.Password,
+		"STORAGE_TYPE":       &c.Storage.Type,
+		"SQLITE_DSN":         &c.Storage.SQLiteDSN,
+		"MATCH_QUEUE":        &c.Match.Queue,
+		"AI_FALLBACK":        &c.Match.AIFallback,
+		"AI_FALLBACK_HOURS":  &c.Match.AIFallbackHours,
+		"ROOM_TRANSPORT":     &c.Room.Transport,
+		"AI_PROVIDER":        &c.AI.Provider,
+		"OPENAI_API_KEY":     &c.AI.APIKey,
+		"OPENAI_MODEL":       &c.AI.Model,
+		"OPENAI_BASE_URL":    &c.AI.BaseURL,
+		"AI_PERSONA_DIR":     &c.AI.PersonaDir,
+		"AI_DEFAULT_PERSONA": &c.AI.DefaultPersona,
+	}
+	for name, field := range stringVars {
+		if value := os.Getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	intVars := map[string]*int{
+		"REDIS_DB":             &c.Redis.DB,
+		"MEMORY_MAX_MESSAGES":  &c.Storage.MemoryMaxMessages,
+		"AI_CONTEXT_BUDGET":    &c.AI.ContextBudget,
+		"AI_SUMMARY_THRESHOLD": &c.AI.SummaryThreshold,
+	}
+	for name, field := range intVars {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = n
+		}
+	}
+
+	durationVars := map[string]*time.Duration{
+		"AUTH_TOKEN_TTL":        &c.Auth.TokenTTL,
+		"HISTORY_TTL":           &c.Storage.HistoryTTL,
+		"AI_FALLBACK_WAIT":      &c.Match.AIFallbackWait,
+		"AI_FALLBACK_MAX_WAIT":  &c.Match.MaxWait,
+		"AI_GREETING_DELAY":     &c.Room.AIGreetingDelay,
+		"AI_REPLY_TIMEOUT":      &c.Room.AIReplyTimeout,
+		"MESSAGE_DEDUPE_WINDOW": &c.Room.DedupeWindow,
+		"RESUME_GRACE":          &c.Room.ResumeGrace,
+	}
+	for name, field := range durationVars {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = d
+		}
+	}
+	return nil
+}
+
+// Validate 校验配置，不修改配置
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr is required"))
+	}
+
+	if c.Auth.Secret != "" && len(c.Auth.Secret) < 32 {
+		errs = append(errs, errors.New("auth.secret must be at least 32 bytes"))
+	}
+	if c.Auth.AdminKey != "" && len(c.Auth.AdminKey) < 16 {
+		errs = append(errs, errors.New("auth.admin_key must be at least 16 bytes"))
+	}
+	if c.Auth.TokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.token_ttl must be positive"))
+	}
+
+	switch c.Storage.Type {
+	case "redis", "memory", "sqlite":
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage.type: %s", c.Storage.Type))
+	}
+	if c.Storage.HistoryTTL <= 0 {
+		errs = append(errs, errors.New("storage.history_ttl must be positive"))
+	}
+
+	switch c.Match.Queue {
+	case "memory", "redis":
+	default:
+		errs = append(errs, fmt.Errorf("unknown match.queue: %s", c.Match.Queue))
+	}
+	if _, err := c.Match.fallbackPolicy(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.Room.Transport {
+	case "local", "redis":
+	default:
+		errs = append(errs, fmt.Errorf("unknown room.transport: %s", c.Room.Transport))
+	}
+	if c.Room.AIReplyTimeout <= 0 {
+		errs = append(errs, errors.New("room.ai_reply_timeout must be positive"))
+	}
+	if c.Room.DedupeWindow <= 0 {
+		errs = append(errs, errors.New("room.dedupe_window must be positive"))
+	}
+	if c.Room.ResumeGrace < 0 {
+		errs = append(errs, errors.New("room.resume_grace must not be negative"))
+	}
+
+	switch c.AI.Provider {
+	case handler.ProviderOpenAI, handler.ProviderOllama, handler.ProviderScripted:
+	default:
+		errs = append(errs, fmt.Errorf("unknown ai.provider: %s", c.AI.Provider))
+	}
+	if c.AI.ContextBudget < 0 {
+		errs = append(errs, errors.New("ai.context_budget must not be negative"))
+	}
+	if c.AI.SummaryThreshold <= handler.SummaryKeepRecent {
+		errs = append(errs, fmt.Errorf("ai.summary_threshold must be greater than %d", handler.SummaryKeepRecent))
+	}
+	if _, err := c.AI.personas(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// FallbackPolicy 返回Load时生成的AI匹配策略
+func (c *Config) FallbackPolicy() *handler.AIFallbackPolicy {
+	return c.fallback
+}
+
+// Personas 返回Load时加载的AI人设
+func (c *Config) Personas() *handler.PersonaRegistry {
+	return c.personas
+}
+
+// fallbackPolicy 根据配置生成AI匹配策略
+func (m MatchConfig) fallbackPolicy() (*handler.AIFallbackPolicy, error) {
+	policy := handler.DefaultAIFallbackPolicy()
+	switch m.AIFallback {
+	case "on":
+	case "off":
+		policy.Enabled = false
+	case "opt-in":
+		policy.RequireOptIn = true
+	default:
+		return nil, fmt.Errorf("unknown match.ai_fallback: %s", m.AIFallback)
+	}
+
+	if m.AIFallbackWait <= 0 {
+		return nil, errors.New("match.ai_fallback_wait must be positive")
+	}
+	if m.MaxWait <= 0 {
+		return nil, errors.New("match.max_wait must be positive")
+	}
+	policy.Wait = m.AIFallbackWait
+	policy.MaxWait = m.MaxWait
+
+	if m.AIFallbackHours != "" {
+		hours, err := handler.ParseHourRanges(m.AIFallbackHours)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match.ai_fallback_hours: %w", err)
+		}
+		policy.Hours = hours
+	}
+	return policy, nil
+}
+
+// personas 加载AI人设并设置默认人设，未配置人设目录时只使用内置人设
+func (a AIConfig) personas() (*handler.PersonaRegistry, error) {
+	personas := handler.NewPersonaRegistry()
+	if a.PersonaDir != "" {
+		var err error
+		if personas, err = handler.LoadPersonas(a.PersonaDir); err != nil {
+			return nil, fmt.Errorf("invalid ai.persona_dir: %w", err)
+		}
+	}
+	if a.DefaultPersona != "" {
+		if err := personas.SetDefault(a.DefaultPersona); err != nil {
+			return nil, fmt.Errorf("invalid ai.default_persona: %w", err)
+		}
+	}
+	return personas, nil
+}
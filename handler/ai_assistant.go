@@ -4,36 +4,49 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
+	"sync"
 
 	"github.com/tmc/langchaingo/llms"
-	"github.com/tmc/langchaingo/llms/openai"
 )
 
+// AIConfig AI客户端配置
+type AIConfig struct {
+	Provider string   // openai/ollama/scripted，默认openai
+	APIKey   string   // openai需要
+	Model    string   // 默认按提供方：gpt-4o-mini / llama3
+	BaseURL  string   // 默认按提供方：https://tbai.xin/v1 / http://localhost:11434
+	Script   []string // scripted的预设回复
+
+	ContextBudget    int // 对话上下文的token预算（含预留给回复的token），默认按模型
+	SummaryThreshold int // 未概括的消息超过该数量时生成对话摘要，默认30
+}
+
 // AIClient 封装AI调用客户端
 type AIClient struct {
-	llm llms.Model
+	llm     llms.Model
+	context *ContextBuilder
+
+	summaryThreshold int
+	summarizing      sync.Map // roomID -> 正在生成摘要
 }
 
-// NewAIClient 创建新的AI客户端
-func NewAIClient() (*AIClient, error) {
-	// 从环境变量获取API密钥
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("OPENAI_API_KEY environment variable is required")
+// NewAIClient 创建新的AI客户端，大模型提供方由config.Provider选择
+func NewAIClient(config AIConfig) (*AIClient, error) {
+	config = config.withDefaults()
+	llm, err := NewLLM(config)
+	if err != nil {
+		return nil, err
 	}
 
-	// 创建OpenAI客户端
-	llm, err := openai.New(
-		openai.WithToken(apiKey),
-		openai.WithModel("gpt-4o-mini"), // 使用支持视觉的模型
-		openai.WithBaseURL("https://tbai.xin/v1"),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create OpenAI client: %w", err)
+	if config.SummaryThreshold <= SummaryKeepRecent {
+		config.SummaryThreshold = defaultSummaryThreshold
 	}
 
-	return &AIClient{llm: llm}, nil
+	return &AIClient{
+		llm:              llm,
+		context:          NewContextBuilder(config.Model, config.ContextBudget),
+		summaryThreshold: config.SummaryThreshold,
+	}, nil
 }
 
 // BasicCall 基础调用示例
@@ -196,81 +209,65 @@ func (c *AIClient) ChatResponse(ctx context.Context, userMessage string) (string
 	return response.Choices[0].Content, nil
 }
 
-// ChatResponseWithContext 带上下文的AI聊天响应（支持文本和图片）
-func (c *AIClient) ChatResponseWithContext(ctx context.Context, userMessage string, messageType string, chatHistory []Message, limit int) (string, error) {
+// greetingPrompt 让AI按人设主动打招呼的用户指令，人设提示作为系统消息单独发送
+const greetingPrompt = "你刚刚与一位新用户匹配成功，对方还没有发言。请按照你的角色设定，用角色设定中的语言主动向对方简短地打个招呼，可以顺便介绍自己能聊些什么。"
+
+// Greeting 以指定人设生成打招呼消息，使用人设的temperature和max_tokens
+func (c *AIClient) Greeting(ctx context.Context, persona *Persona) (string, error) {
 	if c.llm == nil {
-		return "抱歉，AI服务暂时不可用。", fmt.Errorf("AI client not initialized")
+		return "", fmt.Errorf("AI client not initialized")
 	}
 
-	// 构建对话历史消息
-	messages := make([]llms.MessageContent, 0)
-
-	// 添加系统角色提示
-	messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, RolePrompt))
-
-	// 如果有历史消息，构建上下文
-	if len(chatHistory) > 0 {
-		// 限制历史消息数量以避免token超限
-		if limit <= 0 {
-			if messageType == "image" {
-				limit = 8 // 图片处理时使用更少的历史消息以预留token空间
-			} else {
-				limit = 10 // 文本消息默认取最近10条
-			}
-		}
-
-		// 从历史消息中构建对话上下文（倒序取最新的消息）
-		startIdx := 0
-		if len(chatHistory) > limit {
-			startIdx = len(chatHistory) - limit
-		}
+	response, err := c.llm.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, persona.SystemPrompt),
+		llms.TextParts(llms.ChatMessageTypeHuman, greetingPrompt),
+	}, llms.WithTemperature(persona.Temperature), llms.WithMaxTokens(persona.MaxTokens))
+	if err != nil {
+		return "", fmt.Errorf("greeting generation failed: %w", err)
+	}
+	if len(response.Choices) == 0 || response.Choices[0].Content == "" {
+		return "", fmt.Errorf("no response choices available")
+	}
+	return response.Choices[0].Content, nil
+}
 
-		for i := startIdx; i < len(chatHistory); i++ {
-			msg := chatHistory[i]
-			if IsAIUser(msg.From) {
-				// AI的消息（只处理文本类型，AI回复都是文本）
-				if msg.Type == "text" {
-					messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, msg.Content))
-				}
-			} else {
-				// 人类用户的消息（处理文本和图片）
-				switch msg.Type {
-				case "text":
-					messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, msg.Content))
-				case "image":
-					// 将图片消息转换为文本描述加入上下文
-					imageDesc := "[用户之前发送了一张图片]"
-					messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, imageDesc))
-				}
-			}
-		}
+// ChatResponseWithContext 以指定人设进行带上下文的AI聊天响应（支持文本和图片），历史消息按token预算截取，
+// summary不为nil时作为系统提示的一部分，opts可传入额外的调用选项（如流式回调）
+func (c *AIClient) ChatResponseWithContext(ctx context.Context, persona *Persona, userMessage string, messageType string, chatHistory []Message, summary *RoomSummary, opts ...llms.CallOption) (string, error) {
+	if c.llm == nil {
+		return "抱歉，AI服务暂时不可用。", fmt.Errorf("AI client not initialized")
 	}
 
-	// 根据消息类型处理当前消息
+	// 根据消息类型构建当前消息
+	var current llms.MessageContent
 	var maxTokens int
 	switch messageType {
 	case "image":
 		// 处理图片消息（多模态）
 		imagePrompt := "结合上下文对话历史，对用户发送的图片做出专业而温暖的回应。请描述你看到的内容，并结合您的专业背景提供有意义的反馈。"
-		messages = append(messages, llms.MessageContent{
+		current = llms.MessageContent{
 			Role: llms.ChatMessageTypeHuman,
 			Parts: []llms.ContentPart{
 				llms.TextPart(imagePrompt),
 				llms.ImageURLPart(userMessage), // userMessage 是 base64 格式的图片数据
 			},
-		})
-		maxTokens = 250
+		}
+		maxTokens = persona.MaxTokens + 50
 	default:
 		// 处理文本消息
-		messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, userMessage))
-		maxTokens = 200
+		current = llms.TextParts(llms.ChatMessageTypeHuman, userMessage)
+		maxTokens = persona.MaxTokens
 	}
 
+	// 系统角色提示（含对话摘要） + 预算内的历史消息 + 当前消息，为回复预留maxTokens
+	messages := c.context.Build(summarySystemPrompt(persona.SystemPrompt, summary), chatHistory, current, maxTokens)
+
 	// 设置调用选项
 	options := []llms.CallOption{
-		llms.WithTemperature(0.7),
+		llms.WithTemperature(persona.Temperature),
 		llms.WithMaxTokens(maxTokens),
 	}
+	options = append(options, opts...)
 
 	// 执行调用
 	response, err := c.llm.GenerateContent(ctx, messages, options...)
@@ -293,31 +290,35 @@ func (c *AIClient) ChatResponseWithContext(ctx context.Context, userMessage stri
 	return response.Choices[0].Content, nil
 }
 
-// HandleMessageWithContext 带上下文的统一消息处理
-func (c *AIClient) HandleMessageWithContext(ctx context.Context, message Message, storage Storage, roomID string) (string, error) {
-	// 获取聊天历史
+// HandleMessageWithContext 以指定人设带上下文的统一消息处理
+func (c *AIClient) HandleMessageWithContext(ctx context.Context, persona *Persona, message Message, storage Storage, roomID string, opts ...llms.CallOption) (string, error) {
+	if message.Type != "text" && message.Type != "image" {
+		return "抱歉，我目前只能处理文本和图片消息。", fmt.Errorf("unsupported message type: %s", message.Type)
+	}
+
+	// 获取对话摘要和摘要之后的聊天历史，实际使用多少条由token预算决定
 	var chatHistory []Message
+	var summary *RoomSummary
 	if storage != nil {
-		var historyLimit int
-		if message.Type == "image" {
-			historyLimit = 16 // 图片消息获取更少的历史消息
-		} else {
-			historyLimit = 20 // 文本消息获取更多的历史消息
+		var err error
+		if summary, err = storage.GetRoomSummary(roomID); err != nil {
+			log.Printf("Failed to get room summary: %v", err)
 		}
-
-		history, err := storage.GetChatHistory(roomID, historyLimit)
+		history, err := storage.GetChatHistory(roomID, maxContextHistory)
 		if err != nil {
-			log.Printf("Failed to get chat history: %v", err)
 			// 如果获取历史失败，使用无上下文的方式
-			return c.ChatResponseWithContext(ctx, message.Content, message.Type, chatHistory, 10)
+			log.Printf("Failed to get chat history: %v", err)
+		} else {
+			// 当前消息已保存到聊天记录中，作为当前消息单独发送
+			for _, msg := range unsummarized(history, summary) {
+				if msg.ID != message.ID {
+					chatHistory = append(chatHistory, msg)
+				}
+			}
 		}
-		chatHistory = history
-	}
-	if message.Type != "text" && message.Type != "image" {
-		return "抱歉，我目前只能处理文本和图片消息。", fmt.Errorf("unsupported message type: %s", message.Type)
 	}
 
-	return c.ChatResponseWithContext(ctx, message.Content, message.Type, chatHistory, 10)
+	return c.ChatResponseWithContext(ctx, persona, message.Content, message.Type, chatHistory, summary, opts...)
 }
 
 // 验证函数：检查实现的完整性和正确性
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// 构建对话上下文时的token估算参数
+const (
+	defaultContextBudget = 4096 // 未知模型的上下文token预算
+	maxContextHistory    = 50   // 构建上下文时最多读取的历史消息数
+	messageTokenOverhead = 4    // 每条消息的角色、分隔符等额外token
+	imagePartTokens      = 765  // 一张图片占用的token（按OpenAI高清图片1024x1024估算）
+	approxCharsPerToken  = 4    // 无法加载分词器时，英文按每4个字符1个token估算
+)
+
+// 各模型的上下文token预算（不超过模型上下文窗口，同时控制每次调用的成本）
+var modelContextBudgets = map[string]int{
+	"gpt-3.5-turbo": 4096,
+	"gpt-4":         8192,
+	"gpt-4o":        16384,
+	"gpt-4o-mini":   16384,
+	"llama3":        8192,
+	"qwen2.5":       8192,
+}
+
+// ContextBudgetForModel 返回模型的默认上下文token预算，支持带版本后缀的模型名（如 gpt-4o-mini-2024-07-18）
+func ContextBudgetForModel(model string) int {
+	if budget, ok := modelContextBudgets[model]; ok {
+		return budget
+	}
+	match := ""
+	for name := range modelContextBudgets {
+		if strings.HasPrefix(model, name) && len(name) > len(match) {
+			match = name
+		}
+	}
+	if match != "" {
+		return modelContextBudgets[match]
+	}
+	return defaultContextBudget
+}
+
+// TokenCounter 计算文本的token数，分词器在后台加载（需要下载词表），加载完成前使用估算值
+type TokenCounter struct {
+	mu       sync.RWMutex
+	encoding *tiktoken.Tiktoken
+}
+
+// NewTokenCounter 创建token计数器并在后台加载模型对应的分词器，未知模型使用cl100k_base
+func NewTokenCounter(model string) *TokenCounter {
+	tc := &TokenCounter{}
+	go func() {
+		encoding, err := tiktoken.EncodingForModel(model)
+		if err != nil {
+			encoding, err = tiktoken.GetEncoding(tiktoken.MODEL_CL100K_BASE)
+		}
+		if err != nil {
+			log.Printf("Failed to load tokenizer for model %s, using approximate token count: %v", model, err)
+			return
+		}
+		tc.mu.Lock()
+		tc.encoding = encoding
+		tc.mu.Unlock()
+	}()
+	return tc
+}
+
+// Count 计算文本的token数
+func (tc *TokenCounter) Count(text string) int {
+	tc.mu.RLock()
+	encoding := tc.encoding
+	tc.mu.RUnlock()
+	if encoding != nil {
+		return len(encoding.Encode(text, nil, nil))
+	}
+	return approximateTokens(text)
+}
+
+// approximateTokens 估算token数：ASCII字符按每4个1个token，其他字符（如中文）每个按1个token
+func approximateTokens(text string) int {
+	ascii := 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		}
+	}
+	others := utf8.RuneCountInString(text) - ascii
+	return others + (ascii+approxCharsPerToken-1)/approxCharsPerToken
+}
+
+// ContextBuilder 按token预算构建发送给模型的对话上下文
+type ContextBuilder struct {
+	budget  int
+	counter *TokenCounter
+}
+
+// NewContextBuilder 创建上下文构建器，budget<=0时使用模型的默认预算
+func NewContextBuilder(model string, budget int) *ContextBuilder {
+	if budget <= 0 {
+		budget = ContextBudgetForModel(model)
+	}
+	return &ContextBuilder{
+		budget:  budget,
+		counter: NewTokenCounter(model),
+	}
+}
+
+// Build 构建对话上下文：始终保留系统提示和当前消息，为回复预留completionTokens，
+// 剩余预算从最新的历史消息开始向前填充，放不下的更早消息被丢弃
+func (b *ContextBuilder) Build(systemPrompt string, history []Message, current llms.MessageContent, completionTokens int) []llms.MessageContent {
+	used := b.countMessage(llms.TextParts(llms.ChatMessageTypeSystem, systemPrompt)) +
+		b.countMessage(current) +
+		completionTokens
+
+	// 从最新的消息向前取，直到超出预算
+	selected := make([]llms.MessageContent, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		msg, ok := historyMessage(history[i])
+		if !ok {
+			continue
+		}
+		tokens := b.countMessage(msg)
+		if used+tokens > b.budget {
+			break
+		}
+		used += tokens
+		selected = append(selected, msg)
+	}
+
+	messages := make([]llms.MessageContent, 0, len(selected)+2)
+	messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, systemPrompt))
+	for i := len(selected) - 1; i >= 0; i-- {
+		messages = append(messages, selected[i])
+	}
+	return append(messages, current)
+}
+
+// countMessage 计算一条消息占用的token，图片按固定值计算
+func (b *ContextBuilder) countMessage(msg llms.MessageContent) int {
+	tokens := messageTokenOverhead
+	for _, part := range msg.Parts {
+		switch p := part.(type) {
+		case llms.TextContent:
+			tokens += b.counter.Count(p.Text)
+		case llms.ImageURLContent, llms.BinaryContent:
+			tokens += imagePartTokens
+		}
+	}
+	return tokens
+}
+
+// historyMessage 将聊天记录转换为模型消息：AI只保留文本回复，用户的图片替换为文字描述
+func historyMessage(msg Message) (llms.MessageContent, bool) {
+	if IsAIUser(msg.From) {
+		if msg.Type != "text" {
+			return llms.MessageContent{}, false
+		}
+		return llms.TextParts(llms.ChatMessageTypeAI, msg.Content), true
+	}
+
+	switch msg.Type {
+	case "text":
+		return llms.TextParts(llms.ChatMessageTypeHuman, msg.Content), true
+	case "image":
+		return llms.TextParts(llms.ChatMessageTypeHuman, "[用户之前发送了一张图片]"), true
+	default:
+		return llms.MessageContent{}, false
+	}
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 默认的AI匹配策略参数
+const (
+	defaultAIFallbackWait = 10 * time.Second // 等待真人的时间，超时后与AI匹配
+	defaultMatchMaxWait   = 5 * time.Minute  // 不与AI匹配时等待真人的最长时间
+)
+
+// HourRange 一天中的时段 [Start, End)，单位为小时（0-24），Start大于End时跨越午夜
+type HourRange struct {
+	Start int
+	End   int
+}
+
+// Contains 判断小时是否在时段内
+func (r HourRange) Contains(hour int) bool {
+	if r.Start <= r.End {
+		return hour >= r.Start && hour < r.End
+	}
+	return hour >= r.Start || hour < r.End
+}
+
+// AIFallbackPolicy AI匹配策略，决定等待超时后是否与AI匹配
+type AIFallbackPolicy struct {
+	Enabled      bool          // 全局开关，关闭时只与真人匹配
+	RequireOptIn bool          // 只有请求中显式设置ai_fallback=true的用户才与AI匹配
+	Wait         time.Duration // 与AI匹配前等待真人的时间
+	MaxWait      time.Duration // 等待真人的最长时间，超时后匹配失败
+	Hours        []HourRange   // 允许与AI匹配的时段（本地时间），为空表示全天
+}
+
+// DefaultAIFallbackPolicy 默认策略：等待10秒后与AI匹配
+func DefaultAIFallbackPolicy() *AIFallbackPolicy {
+	return &AIFallbackPolicy{
+		Enabled: true,
+		Wait:    defaultAIFallbackWait,
+		MaxWait: defaultMatchMaxWait,
+	}
+}
+
+// Allow 判断请求在指定时间是否允许与AI匹配
+func (p *AIFallbackPolicy) Allow(req MatchRequest, now time.Time) bool {
+	if !p.Enabled {
+		return false
+	}
+	if req.AIFallback != nil {
+		if !*req.AIFallback {
+			return false
+		}
+	} else if p.RequireOptIn {
+		return false
+	}
+	if len(p.Hours) == 0 {
+		return true
+	}
+	for _, r := range p.Hours {
+		if r.Contains(now.Hour()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHourRanges 解析逗号分隔的时段，例如 "22-6,12-14"
+func ParseHourRanges(s string) ([]HourRange, error) {
+	var ranges []HourRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid hour range %q", part)
+		}
+		startHour, err := strconv.Atoi(strings.TrimSpace(start))
+		if err != nil || startHour < 0 || startHour > 24 {
+			return nil, fmt.Errorf("invalid start hour in %q", part)
+		}
+		endHour, err := strconv.Atoi(strings.TrimSpace(end))
+		if err != nil || endHour < 0 || endHour > 24 {
+			return nil, fmt.Errorf("invalid end hour in %q", part)
+		}
+		ranges = append(ranges, HourRange{Start: startHour, End: endHour})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// 对话摘要参数
+const (
+	defaultSummaryThreshold = 30  // 未概括的消息超过该数量时生成摘要
+	SummaryKeepRecent       = 10  // 生成摘要时保留最近的消息不概括，作为原文上下文；摘要阈值必须大于该值
+	summaryMaxTokens        = 300 // 摘要的最大token数
+)
+
+// summaryPrompt 生成对话摘要的系统提示
+const summaryPrompt = `你负责为一段匿名聊天生成摘要，供AI在后续对话中回忆之前聊过的内容。
+请将已有摘要和新的对话合并为一份新的摘要：
+- 保留用户提到的个人信息、经历、偏好、情绪变化和尚未结束的话题
+- 用第三人称描述用户，AI的回复只需概括要点
+- 不超过200字，只输出摘要内容`
+
+// UpdateSummary 房间中未概括的消息超过阈值时，将较早的消息与已有摘要合并为新摘要并保存，
+// 最近SummaryKeepRecent条消息保留原文；同一房间同时只运行一个摘要任务
+func (c *AIClient) UpdateSummary(ctx context.Context, storage Storage, roomID string) {
+	if c.llm == nil || storage == nil {
+		return
+	}
+	if _, running := c.summarizing.LoadOrStore(roomID, struct{}{}); running {
+		return
+	}
+	defer c.summarizing.Delete(roomID)
+
+	summary, err := storage.GetRoomSummary(roomID)
+	if err != nil {
+		log.Printf("Failed to get summary for room %s: %v", roomID, err)
+		return
+	}
+	history, err := storage.GetChatHistory(roomID, maxContextHistory+c.summaryThreshold)
+	if err != nil {
+		log.Printf("Failed to get chat history for room %s: %v", roomID, err)
+		return
+	}
+
+	pending := unsummarized(history, summary)
+	if len(pending) <= c.summaryThreshold {
+		return
+	}
+	older := pending[:len(pending)-SummaryKeepRecent]
+
+	var prompt strings.Builder
+	if summary != nil {
+		fmt.Fprintf(&prompt, "已有摘要：\n%s\n\n", summary.Summary)
+	}
+	prompt.WriteString("新的对话：\n")
+	for _, msg := range older {
+		prompt.WriteString(transcriptLine(msg))
+		prompt.WriteString("\n")
+	}
+
+	response, err := c.llm.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, summaryPrompt),
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt.String()),
+	}, llms.WithTemperature(0.3), llms.WithMaxTokens(summaryMaxTokens))
+	if err != nil {
+		log.Printf("Failed to summarize room %s: %v", roomID, err)
+		return
+	}
+	if len(response.Choices) == 0 || strings.TrimSpace(response.Choices[0].Content) == "" {
+		log.Printf("Failed to summarize room %s: empty response", roomID)
+		return
+	}
+
+	err = storage.SaveRoomSummary(RoomSummary{
+		RoomID:    roomID,
+		Summary:   strings.TrimSpace(response.Choices[0].Content),
+		UpTo:      older[len(older)-1].Timestamp,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to save summary for room %s: %v", roomID, err)
+		return
+	}
+	log.Printf("Summarized %d messages in room %s", len(older), roomID)
+}
+
+// unsummarized 返回摘要之后的聊天记录（聊天记录按时间顺序排列）
+func unsummarized(history []Message, summary *RoomSummary) []Message {
+	if summary == nil {
+		return history
+	}
+	for i, msg := range history {
+		if msg.Timestamp.After(summary.UpTo) {
+			return history[i:]
+		}
+	}
+	return nil
+}
+
+// summarySystemPrompt 将对话摘要附加到人设的系统提示之后
+func summarySystemPrompt(systemPrompt string, summary *RoomSummary) string {
+	if summary == nil {
+		return systemPrompt
+	}
+	return systemPrompt + "\n\n# 之前的对话摘要\n" + summary.Summary + "\n\n以上是你和用户较早的对话内容，回复时请自然地保持连贯，不要复述摘要。"
+}
+
+// transcriptLine 将一条聊天记录转换为摘要用的文本
+func transcriptLine(msg Message) string {
+	from := "用户"
+	if IsAIUser(msg.From) {
+		from = "AI"
+	}
+	content := msg.Content
+	if msg.Type != "text" {
+		content = fmt.Sprintf("[%s]", msg.Type)
+	}
+	return from + "：" + content
+}
@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// 单次AI回复的默认超时时间
+const defaultAIReplyTimeout = 60 * time.Second
+
+// aiWorker AI房间的回复工作协程，保证回复按顺序逐条生成：
+// 用户在生成过程中再次发言时取消正在生成的回复，并将等待中的消息合并为一次回复；
+// 房间关闭时取消正在生成的回复
+type aiWorker struct {
+	room    *Room
+	client  *AIClient
+	timeout time.Duration
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wake chan struct{}
+
+	mu       sync.Mutex
+	pending  []Message          // 等待回复的用户消息
+	inflight context.CancelFunc // 取消正在生成的回复
+}
+
+func newAIWorker(room *Room, client *AIClient, timeout time.Duration) *aiWorker {
+	if timeout <= 0 {
+		timeout = defaultAIReplyTimeout
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	return &aiWorker{
+		room:    room,
+		client:  client,
+		timeout: timeout,
+		ctx:     ctx,
+		stop:    stop,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// enqueue 加入等待回复的消息，并取消正在生成的回复（之后会连同新消息一起回复）
+func (w *aiWorker) enqueue(msg Message) {
+	w.mu.Lock()
+	w.pending = append(w.pending, msg)
+	if w.inflight != nil {
+		w.inflight()
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run 逐条处理等待回复的消息，直到worker停止
+func (w *aiWorker) run() {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.wake:
+		}
+		for w.ctx.Err() == nil {
+			ctx, msg, coalesced, ok := w.next()
+			if !ok {
+				break
+			}
+			if coalesced > 1 {
+				log.Printf("Coalesced %d messages into one AI reply in room %s", coalesced, w.room.ID)
+			}
+			w.reply(ctx, msg)
+		}
+	}
+}
+
+// next 取出等待回复的消息，只回复最新的一条（更早的消息已在聊天记录中），并创建本次生成的上下文
+func (w *aiWorker) next() (context.Context, Message, int, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 {
+		w.inflight = nil
+		return nil, Message{}, 0, false
+	}
+	msg := w.pending[len(w.pending)-1]
+	coalesced := len(w.pending)
+	w.pending = nil
+
+	ctx, cancel := context.WithTimeout(w.ctx, w.timeout)
+	w.inflight = cancel
+	return ctx, msg, coalesced, true
+}
+
+// reply 生成AI回复并以流式帧推送给房间中的人类用户
+func (w *aiWorker) reply(ctx context.Context, userMsg Message) {
+	r := w.room
+	defer func() {
+		w.mu.Lock()
+		if w.inflight != nil {
+			w.inflight()
+			w.inflight = nil
+		}
+		w.mu.Unlock()
+	}()
+
+	// 找到AI用户
+	aiUserID := r.aiUserID()
+	if aiUserID == "" {
+		log.Printf("No AI user found in room %s", r.ID)
+		return
+	}
+
+	msgID := GenerateMessageID()
+	startedAt := time.Now()
+	pacing := r.persona.Pacing
+
+	// 生成期间显示AI正在输入
+	r.sendEvent(aiUserID, EventTyping)
+	defer func() {
+		if w.ctx.Err() == nil {
+			r.sendEvent(aiUserID, EventStoppedTyping)
+		}
+	}()
+
+	// 流式回调：逐块推送增量内容，所有帧使用同一个消息ID；回复被取消后停止推送；
+	// 人设设置了回复节奏时不推送增量内容，生成完成后按节奏一次发送
+	streaming := llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		if pacing.Enabled() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r.sendToHumans(Message{
+			ID:        msgID,
+			From:      aiUserID,
+			Content:   string(chunk),
+			Type:      "text",
+			Timestamp: time.Now(),
+			RoomID:    r.ID,
+			Stream:    StreamChunk,
+		})
+		return nil
+	})
+
+	// 使用带上下文的处理方法
+	aiResponse, err := w.client.HandleMessageWithContext(ctx, r.persona, userMsg, storage, r.ID, streaming)
+
+	// 按回复节奏等待（扣除生成已用的时间，不超过本次回复的超时时间）
+	if err == nil && pacing.Enabled() {
+		wait := pacing.Delay(aiResponse) - time.Since(startedAt)
+		if deadline, ok := ctx.Deadline(); ok {
+			wait = min(wait, time.Until(deadline))
+		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	// 房间已关闭或用户再次发言：丢弃已推送的部分内容，不保存
+	if errors.Is(ctx.Err(), context.Canceled) {
+		if w.ctx.Err() == nil {
+			r.sendToHumans(Message{ID: msgID, From: aiUserID, Type: "text", Timestamp: time.Now(), RoomID: r.ID, Stream: StreamCancelled})
+		}
+		return
+	}
+
+	if err != nil {
+		log.Printf("AI response failed: %v", err)
+		// 根据消息类型发送不同的错误消息
+		switch userMsg.Type {
+		case "image":
+			aiResponse = "我看到你发送了一张图片！不过我暂时无法分析图片内容，但我很乐意和你聊聊其他话题。"
+		default:
+			aiResponse = "抱歉，我现在无法回复您的消息。"
+		}
+	}
+
+	// 创建AI回复消息
+	aiMsg := Message{
+		ID:        msgID,
+		From:      aiUserID,
+		Content:   aiResponse,
+		Type:      "text", // AI回复始终是文本类型
+		Timestamp: time.Now(),
+		RoomID:    r.ID,
+	}
+
+	// 发送结束帧，携带完整内容（出错时替换已推送的部分内容）
+	doneMsg := aiMsg
+	doneMsg.Stream = StreamDone
+	r.sendToHumans(doneMsg)
+
+	// 保存AI消息到存储，并在较早的消息较多时更新对话摘要
+	if storage != nil {
+		if err := storage.SaveMessage(aiMsg); err != nil {
+			log.Printf("Failed to save AI message to storage: %v", err)
+		}
+		// 摘要与回复共用超时，房间关闭时随工作协程一起取消
+		go func() {
+			ctx, cancel := context.WithTimeout(w.ctx, w.timeout)
+			defer cancel()
+			w.client.UpdateSummary(ctx, storage, r.ID)
+		}()
+	}
+}
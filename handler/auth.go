@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toujourser/chat-matcher/middlewares"
+)
+
+// 令牌的默认有效期和用户名的最大长度
+const (
+	defaultTokenTTL   = 24 * time.Hour
+	maxUserNameLength = 32
+)
+
+// adminUserID 管理员令牌中的用户ID
+const adminUserID = "admin"
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// jwtHeader HS256签名的JWT头部，只接受该算法
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenClaims 令牌中的声明
+type tokenClaims struct {
+	Subject   string `json:"sub"`            // 用户ID
+	Role      string `json:"role,omitempty"` // 角色，管理员为admin，普通用户为空
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Authenticator 签发和校验用户令牌（HS256签名的JWT），多实例部署时需要使用相同的密钥
+type Authenticator struct {
+	secret   []byte
+	adminKey string // 换取管理员令牌的密钥，为空时不能以管理员身份登录
+	ttl      time.Duration
+}
+
+// NewAuthenticator 创建令牌签发器，secret为空时生成随机密钥（重启后已签发的令牌失效），ttl不大于0时为24小时
+func NewAuthenticator(secret, adminKey string, ttl time.Duration) *Authenticator {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+		log.Println("No auth secret configured, using a random key: tokens will not survive restarts or work across instances")
+	}
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	return &Authenticator{secret: key, adminKey: adminKey, ttl: ttl}
+}
+
+// Issue 为用户签发令牌，返回令牌和过期时间
+func (a *Authenticator) Issue(userID, role string) (string, time.Time) {
+	now := time.Now()
+	expiresAt := now.Add(a.ttl)
+	payload, _ := json.Marshal(tokenClaims{Subject: userID, Role: role, IssuedAt: now.Unix(), ExpiresAt: expiresAt.Unix()})
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + a.sign(unsigned), expiresAt
+}
+
+// Verify 校验令牌的签名和有效期，返回令牌中的用户ID和角色
+func (a *Authenticator) Verify(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return "", "", ErrInvalidToken
+	}
+	unsigned := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(unsigned))) {
+		return "", "", ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", ErrInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return "", "", ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return "", "", ErrTokenExpired
+	}
+	return claims.Subject, claims.Role, nil
+}
+
+// sign 计算HMAC-SHA256签名
+func (a *Authenticator) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// AnonymousSessionRequest 匿名登录请求
+type AnonymousSessionRequest struct {
+	Name string `json:"name,omitempty"` // 可选，显示的用户名，用户ID为用户名加随机后缀
+}
+
+// AuthSession 登录结果，之后的请求通过 Authorization: Bearer <token> 或 token 查询参数携带令牌
+type AuthSession struct {
+	Token     string    `json:"token"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AnonymousSessionHandle 创建匿名会话：由服务端生成用户ID并签发令牌 (Gin版本)
+func AnonymousSessionHandle(c *gin.Context) {
+	var req AnonymousSessionRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "guest"
+	}
+	if !validUserName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name: use up to 32 letters, digits, '_' or '-'"})
+		return
+	}
+
+	// AI用户ID以ai_开头，避免用户名为ai时与AI用户混淆
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	userID := name + "_" + hex.EncodeToString(suffix)
+	if IsAIUser(userID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name: reserved for AI users"})
+		return
+	}
+	token, expiresAt := authenticator.Issue(userID, "")
+
+	log.Printf("用户 %s 创建了匿名会话", userID)
+	c.JSON(http.StatusOK, AuthSession{Token: token, UserID: userID, ExpiresAt: expiresAt})
+}
+
+// AdminSessionRequest 管理员登录请求
+type AdminSessionRequest struct {
+	Key string `json:"key"` // 配置中的管理员密钥
+}
+
+// AdminSessionHandle 使用管理员密钥换取管理员令牌，可以查看任意房间的聊天记录和任意用户的数据 (Gin版本)
+func AdminSessionHandle(c *gin.Context) {
+	var req AdminSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if authenticator.adminKey == "" || subtle.ConstantTimeCompare([]byte(req.Key), []byte(authenticator.adminKey)) != 1 {
+		log.Printf("Rejected admin login from %s", c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin key"})
+		return
+	}
+	token, expiresAt := authenticator.Issue(adminUserID, middlewares.RoleAdmin)
+
+	log.Printf("管理员从 %s 登录", c.ClientIP())
+	c.JSON(http.StatusOK, AuthSession{Token: token, UserID: adminUserID, ExpiresAt: expiresAt})
+}
+
+// validUserName 用户名只能包含字母、数字、下划线和连字符
+func validUserName(name string) bool {
+	if utf8.RuneCountInString(name) > maxUserNameLength {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
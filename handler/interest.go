@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// 兴趣匹配放宽条件的等待时间阈值（取双方中较长的等待时间）
+const (
+	interestStrictWait = 5 * time.Second  // 低于此时间：要求语言一致且至少有一个共同标签
+	interestRelaxWait  = 15 * time.Second // 低于此时间：只要求语言一致；超过后不再限制
+)
+
+// normalizeTags 标签统一转小写、去空白并去重
+func normalizeTags(tags []string) []string {
+	normalized := lo.FilterMap(tags, func(tag string, _ int) (string, bool) {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		return tag, tag != ""
+	})
+	return lo.Uniq(normalized)
+}
+
+// commonTags 返回两组标签的交集（保持a中的顺序）
+func commonTags(a, b []string) []string {
+	return lo.Intersect(b, a)
+}
+
+// compatible 根据等待时间判断两个用户当前是否可以匹配
+func compatible(a, b WaitingUser, common []string, now time.Time) bool {
+	wait := now.Sub(a.EnqueuedAt)
+	if w := now.Sub(b.EnqueuedAt); w > wait {
+		wait = w
+	}
+
+	if wait >= interestRelaxWait {
+		return true
+	}
+	// 双方都指定了语言时必须一致
+	if a.Language != "" && b.Language != "" && !strings.EqualFold(a.Language, b.Language) {
+		return false
+	}
+	if wait >= interestStrictWait {
+		return true
+	}
+	// 任何一方填写了标签时至少要有一个共同标签
+	if len(a.Tags) > 0 || len(b.Tags) > 0 {
+		return len(common) > 0
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// 大模型提供方，AIClient通过langchaingo的llms.Model接口调用
+const (
+	ProviderOpenAI   = "openai"   // OpenAI兼容接口
+	ProviderOllama   = "ollama"   // Ollama本地服务
+	ProviderScripted = "scripted" // 按预设回复应答的假模型（离线运行和测试）
+)
+
+// 各提供方的默认配置
+const (
+	DefaultAIModel       = "gpt-4o-mini" // 使用支持视觉的模型
+	DefaultAIBaseURL     = "https://tbai.xin/v1"
+	DefaultOllamaModel   = "llama3"
+	DefaultOllamaBaseURL = "http://localhost:11434"
+)
+
+// withDefaults 为未设置的模型和接口地址填充提供方的默认值
+func (config AIConfig) withDefaults() AIConfig {
+	switch config.Provider {
+	case "", ProviderOpenAI:
+		config.Provider = ProviderOpenAI
+		if config.Model == "" {
+			config.Model = DefaultAIModel
+		}
+		if config.BaseURL == "" {
+			config.BaseURL = DefaultAIBaseURL
+		}
+	case ProviderOllama:
+		if config.Model == "" {
+			config.Model = DefaultOllamaModel
+		}
+		if config.BaseURL == "" {
+			config.BaseURL = DefaultOllamaBaseURL
+		}
+	}
+	return config
+}
+
+// NewLLM 根据配置创建大模型
+func NewLLM(config AIConfig) (llms.Model, error) {
+	config = config.withDefaults()
+	switch config.Provider {
+	case ProviderOpenAI:
+		if config.APIKey == "" {
+			return nil, fmt.Errorf("AI API key is required (ai.api_key or OPENAI_API_KEY)")
+		}
+		llm, err := openai.New(
+			openai.WithToken(config.APIKey),
+			openai.WithModel(config.Model),
+			openai.WithBaseURL(config.BaseURL),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OpenAI client: %w", err)
+		}
+		return llm, nil
+
+	case ProviderOllama:
+		llm, err := ollama.New(
+			ollama.WithModel(config.Model),
+			ollama.WithServerURL(config.BaseURL),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Ollama client: %w", err)
+		}
+		return llm, nil
+
+	case ProviderScripted:
+		return NewScriptedLLM(config.Script), nil
+
+	default:
+		return nil, fmt.Errorf("unknown AI provider: %s", config.Provider)
+	}
+}
+
+// scripted提供方没有预设回复时使用的回复，以及流式推送时每块的字符数
+const (
+	defaultScriptedReply = "你好！我是AI聊天伙伴，有什么想聊的吗？"
+	scriptedChunkRunes   = 4
+)
+
+// ScriptedLLM 按顺序循环返回预设回复的假模型，回复与输入无关，便于离线运行和测试
+type ScriptedLLM struct {
+	mu      sync.Mutex
+	replies []string
+	next    int
+}
+
+// NewScriptedLLM 创建假模型，replies为空时总是返回默认回复
+func NewScriptedLLM(replies []string) *ScriptedLLM {
+	if len(replies) == 0 {
+		replies = []string{defaultScriptedReply}
+	}
+	return &ScriptedLLM{replies: replies}
+}
+
+// GenerateContent 返回下一条预设回复
+func (s *ScriptedLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	s.mu.Lock()
+	reply := s.replies[s.next%len(s.replies)]
+	s.next++
+	s.mu.Unlock()
+
+	// 设置了流式回调时按scriptedChunkRunes个字符分块推送
+	opts := llms.CallOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.StreamingFunc != nil {
+		runes := []rune(reply)
+		for start := 0; start < len(runes); start += scriptedChunkRunes {
+			end := min(start+scriptedChunkRunes, len(runes))
+			if err := opts.StreamingFunc(ctx, []byte(string(runes[start:end]))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &llms.ContentResponse{
+		Choices: []*llms.ContentChoice{{Content: reply}},
+	}, nil
+}
+
+// Call 单轮文本调用
+func (s *ScriptedLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, s, prompt, options...)
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"log"
+	"time"
+)
+
+// 大厅事件流读取用户状态的间隔
+const lobbyPushInterval = 500 * time.Millisecond
+
+// MatchEventType 匹配生命周期事件类型
+type MatchEventType string
+
+const (
+	MatchEventQueued    MatchEventType = "queued"     // 进入等待池
+	MatchEventPosition  MatchEventType = "position"   // 排队位置变化
+	MatchEventMatched   MatchEventType = "matched"    // 与真人匹配成功
+	MatchEventAIMatched MatchEventType = "ai_matched" // 超时后与AI匹配
+	MatchEventCancelled MatchEventType = "cancelled"  // 取消匹配
+)
+
+// MatchEvent 匹配生命周期事件，通过 GET /api/lobby/events 推送
+type MatchEvent struct {
+	Type       MatchEventType `json:"type"`
+	UserID     string         `json:"user_id"`
+	State      UserState      `json:"state"`
+	Position   int            `json:"position,omitempty"` // 在等待池中的位置，从1开始
+	RoomID     string         `json:"room_id,omitempty"`
+	PartnerID  string         `json:"partner_id,omitempty"`
+	CommonTags []string       `json:"common_tags,omitempty"`
+	Persona    *PersonaInfo   `json:"persona,omitempty"` // 与AI匹配时的AI人设
+	Timestamp  time.Time      `json:"timestamp"`
+}
+
+// matchSnapshot 某一时刻用户的匹配状态
+type matchSnapshot struct {
+	state      UserState
+	position   int
+	assignment *MatchAssignment
+}
+
+// snapshot 读取用户当前的匹配状态（状态保存在匹配队列中，其他实例上的状态变化也能读到）
+func (m *Matcher) snapshot(userID string) matchSnapshot {
+	var snap matchSnapshot
+	state, ok, err := m.queue.GetState(userID)
+	if err != nil {
+		log.Printf("Failed to get state for user %s: %v", userID, err)
+		return snap
+	}
+	if !ok {
+		return snap
+	}
+	snap.state = state
+
+	switch state {
+	case StateMatching:
+		position, err := m.queue.Position(userID)
+		if err != nil {
+			log.Printf("Failed to get queue position for user %s: %v", userID, err)
+			break
+		}
+		snap.position = position
+	case StateChatting:
+		snap.assignment = m.GetAssignment(userID)
+	}
+	return snap
+}
+
+// matchEvents 根据前后两次状态生成生命周期事件
+func matchEvents(userID string, prev, cur matchSnapshot) []MatchEvent {
+	now := time.Now()
+	event := MatchEvent{UserID: userID, State: cur.state, Timestamp: now}
+
+	switch cur.state {
+	case StateMatching:
+		event.Position = cur.position
+		if prev.state != StateMatching {
+			event.Type = MatchEventQueued
+			return []MatchEvent{event}
+		}
+		if cur.position != prev.position && cur.position > 0 {
+			event.Type = MatchEventPosition
+			return []MatchEvent{event}
+		}
+
+	case StateChatting:
+		// 匹配结果写入前状态可能已更新，等拿到房间后再推送
+		if cur.assignment == nil {
+			return nil
+		}
+		if prev.state == StateChatting && prev.assignment != nil && prev.assignment.RoomID == cur.assignment.RoomID {
+			return nil
+		}
+		event.Type = MatchEventMatched
+		if IsAIUser(cur.assignment.PartnerID) {
+			event.Type = MatchEventAIMatched
+		}
+		event.RoomID = cur.assignment.RoomID
+		event.PartnerID = cur.assignment.PartnerID
+		event.CommonTags = cur.assignment.CommonTags
+		event.Persona = cur.assignment.Persona
+		return []MatchEvent{event}
+
+	default:
+		if prev.state == StateMatching {
+			event.Type = MatchEventCancelled
+			event.State = StateIdle
+			return []MatchEvent{event}
+		}
+	}
+	return nil
+}
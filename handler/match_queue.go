@@ -0,0 +1,373 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// MatchAssignment 用户的匹配结果
+type MatchAssignment struct {
+	RoomID     string       `json:"room_id"`
+	PartnerID  string       `json:"partner_id"`
+	CommonTags []string     `json:"common_tags,omitempty"` // 双方共同的兴趣标签
+	Persona    *PersonaInfo `json:"persona,omitempty"`     // 与AI匹配时的AI人设
+}
+
+// ResumeSession 用户在房间中的连接会话，保存在匹配队列中，断线后可以在任意实例上恢复
+type ResumeSession struct {
+	RoomID         string    `json:"room_id"`
+	Token          string    `json:"token"`                     // 恢复会话的令牌
+	DisconnectedAt time.Time `json:"disconnected_at,omitempty"` // 连接意外断开的时间，在线时为零
+	Deadline       time.Time `json:"deadline,omitempty"`        // 宽限期结束的时间，之后会话失效；在线时为零
+}
+
+// expired 宽限期已结束
+func (s ResumeSession) expired(now time.Time) bool {
+	return !s.Deadline.IsZero() && now.After(s.Deadline)
+}
+
+// WaitingUser 等待池中的用户
+type WaitingUser struct {
+	UserID      string    `json:"user_id"`
+	Tags        []string  `json:"tags,omitempty"`         // 兴趣标签
+	Language    string    `json:"language,omitempty"`     // 偏好语言
+	AvoidRecent bool      `json:"avoid_recent,omitempty"` // 不与最近匹配过的用户再次匹配
+	EnqueuedAt  time.Time `json:"enqueued_at"`            // 加入等待池的时间
+}
+
+// 最近匹配记录的保留时间
+const recentPartnerWindow = 30 * time.Minute
+
+// MatchQueue 匹配队列后端，保存等待匹配的用户池、用户状态和匹配结果
+type MatchQueue interface {
+	// BeginMatching 将用户状态设置为匹配中，用户已在聊天中时不修改并返回false
+	BeginMatching(userID string) (bool, error)
+	// Enqueue 将用户加入等待池，已在等待池中时只更新标签和语言（保留加入时间）；
+	// 用户状态不是匹配中（已被其他用户领取或已取消）时不加入
+	Enqueue(user WaitingUser) error
+	// Cancel 原子地将匹配中的用户移出等待池并设置为空闲，用户已在聊天中（已被领取）时不修改并返回false
+	Cancel(userID string) (bool, error)
+	// Waiting 按加入顺序返回等待池中的用户
+	Waiting() ([]WaitingUser, error)
+	// Position 返回用户在等待池中的位置（从1开始），不在等待池中时返回0
+	Position(userID string) (int, error)
+	// Claim 原子地领取partner：user和partner都在匹配中且partner仍在等待池中时，将双方移出等待池，
+	// 设置为聊天中并记录双方的匹配结果；否则返回false。partner不在匹配中（状态已过期）时将其移出等待池
+	Claim(userID, partnerID string, assignment, partnerAssignment MatchAssignment) (bool, error)
+	// Withdraw 原子地将匹配中的用户移出等待池，设置为聊天中并记录匹配结果（与AI匹配时使用）；
+	// 用户已被其他用户领取（不在等待池中）时不做修改并返回false
+	Withdraw(userID string, assignment MatchAssignment) (bool, error)
+
+	// GetState 获取用户状态
+	GetState(userID string) (UserState, bool, error)
+
+	// GetAssignment 获取Claim或Withdraw记录的匹配结果，供对方（可能在其他实例上）查询
+	GetAssignment(userID string) (*MatchAssignment, error)
+
+	// RememberPartner 记录最近匹配过的用户，RecentPartners返回recentPartnerWindow内的记录
+	RememberPartner(userID, partnerID string) error
+	RecentPartners(userID string) ([]string, error)
+
+	// 匹配票据相关，每个用户只保留最近一张票据
+	// CreateTicket 用户没有等待中的票据时保存新票据并返回true，否则不修改并返回已有的票据（原子操作，防止重复请求启动多个匹配）
+	CreateTicket(ticket MatchTicket) (*MatchTicket, bool, error)
+	// UpdateTicket 票据当前状态为from时保存票据，否则不修改并返回false（取消与匹配成功竞争时只有一方生效）
+	UpdateTicket(ticket MatchTicket, from TicketStatus) (bool, error)
+	GetTicket(ticketID string) (*MatchTicket, error)
+	GetUserTicket(userID string) (*MatchTicket, error)
+
+	// 断线重连相关，每个用户只保留最近一次连接的会话
+	// SaveResume previous为空时直接保存会话，否则只在当前会话的令牌为previous时保存，不满足时返回false
+	SaveResume(userID string, session ResumeSession, previous string) (bool, error)
+	// GetResume 获取用户的会话，不存在或宽限期已结束时返回nil
+	GetResume(userID string) (*ResumeSession, error)
+	// ClearResume 删除用户的会话；会话的令牌不是token（已在其他连接上恢复）时不删除并返回false
+	ClearResume(userID, token string) (bool, error)
+
+	// Reset 清除用户状态和匹配结果
+	Reset(userID string) error
+}
+
+// MemoryMatchQueue 进程内匹配队列（单实例部署）
+type MemoryMatchQueue struct {
+	mu           sync.Mutex
+	waitingUsers []WaitingUser                   // 等待匹配的用户队列
+	userStates   map[string]UserState            // 用户状态map
+	assignments  map[string]MatchAssignment      // 用户匹配结果
+	recent       map[string]map[string]time.Time // 用户最近匹配过的用户及匹配时间
+	tickets      map[string]MatchTicket          // 匹配票据
+	userTickets  map[string]string               // userID -> 最近的票据ID
+	resumes      map[string]ResumeSession        // userID -> 连接会话
+}
+
+// NewMemoryMatchQueue 创建进程内匹配队列
+func NewMemoryMatchQueue() MatchQueue {
+	return &MemoryMatchQueue{
+		userStates:  make(map[string]UserState),
+		assignments: make(map[string]MatchAssignment),
+		recent:      make(map[string]map[string]time.Time),
+		tickets:     make(map[string]MatchTicket),
+		userTickets: make(map[string]string),
+		resumes:     make(map[string]ResumeSession),
+	}
+}
+
+// indexOf 查找用户在等待队列中的位置（调用方需持有锁）
+func (q *MemoryMatchQueue) indexOf(userID string) int {
+	for i, user := range q.waitingUsers {
+		if user.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeAt 从等待队列中移除指定位置的用户（调用方需持有锁）
+func (q *MemoryMatchQueue) removeAt(idx int) {
+	q.waitingUsers = append(q.waitingUsers[:idx], q.waitingUsers[idx+1:]...)
+}
+
+// BeginMatching 将用户状态设置为匹配中
+func (q *MemoryMatchQueue) BeginMatching(userID string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.userStates[userID] == StateChatting {
+		return false, nil
+	}
+	q.userStates[userID] = StateMatching
+	return true, nil
+}
+
+// Enqueue 将用户加入等待池
+func (q *MemoryMatchQueue) Enqueue(user WaitingUser) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.userStates[user.UserID] != StateMatching {
+		return nil
+	}
+	if idx := q.indexOf(user.UserID); idx >= 0 {
+		q.waitingUsers[idx].Tags = user.Tags
+		q.waitingUsers[idx].Language = user.Language
+		q.waitingUsers[idx].AvoidRecent = user.AvoidRecent
+		return nil
+	}
+	if user.EnqueuedAt.IsZero() {
+		user.EnqueuedAt = time.Now()
+	}
+	q.waitingUsers = append(q.waitingUsers, user)
+	return nil
+}
+
+// Cancel 将匹配中的用户移出等待池并设置为空闲
+func (q *MemoryMatchQueue) Cancel(userID string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.userStates[userID] == StateChatting {
+		return false, nil
+	}
+	if idx := q.indexOf(userID); idx >= 0 {
+		q.removeAt(idx)
+	}
+	q.userStates[userID] = StateIdle
+	return true, nil
+}
+
+// Waiting 返回等待池中的用户
+func (q *MemoryMatchQueue) Waiting() ([]WaitingUser, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]WaitingUser(nil), q.waitingUsers...), nil
+}
+
+// Position 返回用户在等待池中的位置
+func (q *MemoryMatchQueue) Position(userID string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.indexOf(userID) + 1, nil
+}
+
+// Claim 领取等待中的partner
+func (q *MemoryMatchQueue) Claim(userID, partnerID string, assignment, partnerAssignment MatchAssignment) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.userStates[userID] != StateMatching {
+		return false, nil
+	}
+	idx := q.indexOf(partnerID)
+	if idx < 0 {
+		return false, nil
+	}
+	q.removeAt(idx)
+	if q.userStates[partnerID] != StateMatching {
+		return false, nil
+	}
+	if idx := q.indexOf(userID); idx >= 0 {
+		q.removeAt(idx)
+	}
+	q.userStates[userID] = StateChatting
+	q.userStates[partnerID] = StateChatting
+	q.assignments[userID] = assignment
+	q.assignments[partnerID] = partnerAssignment
+	return true, nil
+}
+
+// Withdraw 将匹配中的用户移出等待池并记录匹配结果
+func (q *MemoryMatchQueue) Withdraw(userID string, assignment MatchAssignment) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	idx := q.indexOf(userID)
+	if q.userStates[userID] != StateMatching || idx < 0 {
+		return false, nil
+	}
+	q.removeAt(idx)
+	q.userStates[userID] = StateChatting
+	q.assignments[userID] = assignment
+	return true, nil
+}
+
+// GetState 获取用户状态
+func (q *MemoryMatchQueue) GetState(userID string) (UserState, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	state, ok := q.userStates[userID]
+	return state, ok, nil
+}
+
+// GetAssignment 获取匹配结果，没有匹配结果时返回nil
+func (q *MemoryMatchQueue) GetAssignment(userID string) (*MatchAssignment, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if assignment, ok := q.assignments[userID]; ok {
+		return &assignment, nil
+	}
+	return nil, nil
+}
+
+// RememberPartner 记录最近匹配过的用户
+func (q *MemoryMatchQueue) RememberPartner(userID, partnerID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	partners, ok := q.recent[userID]
+	if !ok {
+		partners = make(map[string]time.Time)
+		q.recent[userID] = partners
+	}
+	partners[partnerID] = time.Now()
+	return nil
+}
+
+// RecentPartners 返回最近匹配过的用户，同时清理过期记录
+func (q *MemoryMatchQueue) RecentPartners(userID string) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cutoff := time.Now().Add(-recentPartnerWindow)
+	var partners []string
+	for partnerID, matchedAt := range q.recent[userID] {
+		if matchedAt.Before(cutoff) {
+			delete(q.recent[userID], partnerID)
+			continue
+		}
+		partners = append(partners, partnerID)
+	}
+	return partners, nil
+}
+
+// CreateTicket 用户没有等待中的票据时保存新票据，同一用户已结束的旧票据会被清除
+func (q *MemoryMatchQueue) CreateTicket(ticket MatchTicket) (*MatchTicket, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if previous, ok := q.tickets[q.userTickets[ticket.UserID]]; ok {
+		if previous.Status == TicketQueued {
+			return &previous, false, nil
+		}
+		delete(q.tickets, previous.ID)
+	}
+	q.tickets[ticket.ID] = ticket
+	q.userTickets[ticket.UserID] = ticket.ID
+	return &ticket, true, nil
+}
+
+// UpdateTicket 票据当前状态为from时保存票据
+func (q *MemoryMatchQueue) UpdateTicket(ticket MatchTicket, from TicketStatus) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current, ok := q.tickets[ticket.ID]
+	if !ok || current.Status != from {
+		return false, nil
+	}
+	q.tickets[ticket.ID] = ticket
+	return true, nil
+}
+
+// GetTicket 获取匹配票据，不存在时返回nil
+func (q *MemoryMatchQueue) GetTicket(ticketID string) (*MatchTicket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ticket, ok := q.tickets[ticketID]; ok {
+		return &ticket, nil
+	}
+	return nil, nil
+}
+
+// GetUserTicket 获取用户最近的匹配票据，不存在时返回nil
+func (q *MemoryMatchQueue) GetUserTicket(userID string) (*MatchTicket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ticket, ok := q.tickets[q.userTickets[userID]]; ok {
+		return &ticket, nil
+	}
+	return nil, nil
+}
+
+// resume 获取用户的会话，同时清理宽限期已结束的会话（调用方需持有锁）
+func (q *MemoryMatchQueue) resume(userID string) (ResumeSession, bool) {
+	session, ok := q.resumes[userID]
+	if ok && session.expired(time.Now()) {
+		delete(q.resumes, userID)
+		return ResumeSession{}, false
+	}
+	return session, ok
+}
+
+// SaveResume 保存用户的会话，previous不为空时只替换令牌为previous的会话
+func (q *MemoryMatchQueue) SaveResume(userID string, session ResumeSession, previous string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if previous != "" {
+		if current, ok := q.resume(userID); !ok || current.Token != previous {
+			return false, nil
+		}
+	}
+	q.resumes[userID] = session
+	return true, nil
+}
+
+// GetResume 获取用户的会话，不存在或宽限期已结束时返回nil
+func (q *MemoryMatchQueue) GetResume(userID string) (*ResumeSession, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if session, ok := q.resume(userID); ok {
+		return &session, nil
+	}
+	return nil, nil
+}
+
+// ClearResume 删除令牌为token的会话
+func (q *MemoryMatchQueue) ClearResume(userID, token string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if current, ok := q.resume(userID); ok && current.Token != token {
+		return false, nil
+	}
+	delete(q.resumes, userID)
+	return true, nil
+}
+
+// Reset 清除用户状态和匹配结果
+func (q *MemoryMatchQueue) Reset(userID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.userStates, userID)
+	delete(q.assignments, userID)
+	return nil
+}
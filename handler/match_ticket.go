@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"log"
+	"time"
+)
+
+// 匹配票据的轮询间隔
+const (
+	matchInterval = 1 * time.Second
+
+	ticketPushInterval = 500 * time.Millisecond // SSE推送时读取票据状态的间隔
+)
+
+// TicketStatus 匹配票据状态
+type TicketStatus string
+
+const (
+	TicketQueued    TicketStatus = "queued"    // 等待匹配
+	TicketMatched   TicketStatus = "matched"   // 匹配成功
+	TicketCancelled TicketStatus = "cancelled" // 已取消
+	TicketFailed    TicketStatus = "failed"    // 匹配失败（AI匹配也失败）
+)
+
+// MatchTicket 匹配票据，POST /api/match 立即返回，客户端通过票据ID查询或取消匹配
+type MatchTicket struct {
+	ID     string       `json:"ticket_id"`
+	UserID string       `json:"user_id"`
+	Status TicketStatus `json:"status"`
+	MatchResponse
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GenerateTicketID 生成匹配票据ID
+func GenerateTicketID() string {
+	return "t_" + GenerateMessageID()
+}
+
+// updateTicket 票据仍在等待时更新票据，票据已被取消（可能在其他实例上）时返回false
+func updateTicket(ticket *MatchTicket) bool {
+	ticket.UpdatedAt = time.Now()
+	updated, err := matcher.queue.UpdateTicket(*ticket, TicketQueued)
+	if err != nil {
+		log.Printf("Failed to update match ticket %s: %v", ticket.ID, err)
+		return false
+	}
+	return updated
+}
+
+// abandonMatch 票据已取消但用户已被匹配（取消与匹配交错）时离开房间，对方的票据仍在等待时让对方重新匹配
+func abandonMatch(userID string) {
+	assignment := matcher.GetAssignment(userID)
+	if assignment == nil {
+		matcher.ResetUser(userID)
+		return
+	}
+	log.Printf("用户 %s 已取消匹配，离开房间 %s", userID, assignment.RoomID)
+	roomManager.AbandonRoom(assignment.RoomID, userID)
+	if IsAIUser(assignment.PartnerID) {
+		return
+	}
+	if ticket, err := matcher.queue.GetUserTicket(assignment.PartnerID); err == nil && ticket != nil && ticket.Status == TicketQueued {
+		roomManager.AbandonRoom(assignment.RoomID, assignment.PartnerID)
+		matcher.BeginMatching(assignment.PartnerID)
+	}
+}
+
+// runMatchTicket 后台为票据执行匹配，按AI匹配策略决定超时后是否与AI匹配
+func runMatchTicket(ticket MatchTicket, req MatchRequest) {
+	policy := matcher.fallback
+
+	ticker := time.NewTicker(matchInterval)
+	defer ticker.Stop()
+
+	// 已在聊天中时下面的match直接返回当前的匹配结果
+	matcher.BeginMatching(req.UserID)
+
+	for {
+		current, err := matcher.queue.GetUserTicket(req.UserID)
+		if err == nil && (current == nil || current.ID != ticket.ID) {
+			// 票据已过期或被新票据替换，新票据的匹配协程负责该用户
+			if current == nil {
+				matcher.CancelMatch(req.UserID)
+			}
+			log.Printf("用户 %s 的票据 %s 已失效，停止匹配", req.UserID, ticket.ID)
+			return
+		}
+		// 票据被取消（可能在其他实例上）后停止匹配
+		if err == nil && current.Status == TicketCancelled {
+			// 取消与本轮匹配可能交错，再次移出等待池；已被其他用户领取时离开房间
+			if !matcher.CancelMatch(req.UserID) {
+				abandonMatch(req.UserID)
+			}
+			log.Printf("用户 %s 取消了匹配，票据 ID：%s", req.UserID, ticket.ID)
+			return
+		}
+
+		resp := match(req)
+		if resp.Matched {
+			log.Printf("用户 ID：%s, 匹配结果：%v, 房间 ID：%s, 对方 ID：%s", req.UserID, resp.Matched, resp.RoomID, resp.Partner)
+			ticket.Status = TicketMatched
+			ticket.MatchResponse = resp
+			if !updateTicket(&ticket) {
+				abandonMatch(req.UserID)
+			}
+			return
+		}
+
+		waited := time.Since(ticket.CreatedAt)
+		if waited >= policy.Wait && policy.Allow(req, time.Now()) {
+			// 超时后与AI匹配
+			log.Printf("用户 %s 匹配超时，尝试与AI匹配", req.UserID)
+			persona := roomManager.personas.Pick(req.Persona)
+			roomID, aiUserID, matched := matcher.MatchWithAI(req.UserID, persona)
+			if matched {
+				ticket.Status = TicketMatched
+				ticket.MatchResponse = MatchResponse{Matched: true, RoomID: roomID, Partner: aiUserID, Persona: persona.Info()}
+				// 创建AI房间，票据更新后客户端即可加入
+				roomManager.CreateAIRoom(roomID, req.UserID, aiUserID, persona)
+				log.Printf("用户 %s 成功与AI %s（%s）匹配，房间 ID：%s", req.UserID, aiUserID, persona.Name, roomID)
+			} else if resp, ok := currentMatch(req.UserID); ok {
+				// 与AI匹配前已被其他用户领取
+				ticket.Status = TicketMatched
+				ticket.MatchResponse = resp
+				log.Printf("用户 %s 在与AI匹配前已与 %s 匹配，房间 ID：%s", req.UserID, resp.Partner, resp.RoomID)
+			} else {
+				ticket.Status = TicketFailed
+				log.Printf("用户 %s AI匹配失败", req.UserID)
+			}
+			if !updateTicket(&ticket) && ticket.Status == TicketMatched {
+				abandonMatch(req.UserID)
+			}
+			return
+		}
+
+		// 不允许与AI匹配且等待过久，移出等待池；此时已被其他用户领取则继续等待下一轮返回匹配结果
+		if waited >= policy.MaxWait && matcher.CancelMatch(req.UserID) {
+			ticket.Status = TicketFailed
+			updateTicket(&ticket)
+			log.Printf("用户 %s 等待 %v 仍未匹配到真人，匹配失败", req.UserID, policy.MaxWait)
+			return
+		}
+
+		<-ticker.C
+	}
+}
@@ -3,61 +3,197 @@ package handler
 import (
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
-
-	"github.com/samber/lo"
+	"time"
 )
 
+// 领取等待用户失败（被其他实例抢先）时的最大重试次数
+const maxClaimAttempts = 3
+
 type Matcher struct {
-	waitingUsers []string // 等待匹配的用户ID队列
-	mu           sync.Mutex
-	userStates   map[string]UserState // 用户状态map
-	storage      Storage              // 添加存储接口
-	aiClient     *AIClient            // AI客户端
+	mu       sync.Mutex
+	queue    MatchQueue        // 等待池和用户状态（进程内或Redis）
+	storage  Storage           // 添加存储接口
+	aiClient *AIClient         // AI客户端
+	fallback *AIFallbackPolicy // AI匹配策略
 }
 
-func NewMatcher(storage Storage) *Matcher {
+// MatcherConfig 匹配器配置
+type MatcherConfig struct {
+	AI       AIConfig          // AI客户端配置
+	Fallback *AIFallbackPolicy // AI匹配策略，为nil时使用默认策略
+}
+
+func NewMatcher(storage Storage, queue MatchQueue, config MatcherConfig) *Matcher {
 	// 初始化AI客户端
-	aiClient, err := NewAIClient()
+	aiClient, err := NewAIClient(config.AI)
 	if err != nil {
 		log.Printf("Warning: Failed to initialize AI client: %v", err)
 	}
 
+	if queue == nil {
+		queue = NewMemoryMatchQueue()
+	}
+	fallback := config.Fallback
+	if fallback == nil {
+		fallback = DefaultAIFallbackPolicy()
+	}
+
 	return &Matcher{
-		userStates: make(map[string]UserState),
-		storage:    storage,
-		aiClient:   aiClient,
+		queue:    queue,
+		storage:  storage,
+		aiClient: aiClient,
+		fallback: fallback,
 	}
 }
 
-// RequestMatch 用户请求匹配
-func (m *Matcher) RequestMatch(userID string) (string, string, bool) {
+// BeginMatching 开始匹配，用户已在聊天中（已被其他用户领取）时返回false
+func (m *Matcher) BeginMatching(userID string) bool {
+	ok, err := m.queue.BeginMatching(userID)
+	if err != nil {
+		log.Printf("Failed to begin matching for user %s: %v", userID, err)
+		return false
+	}
+	return ok
+}
+
+// RequestMatch 用户请求匹配，优先选择共同兴趣标签最多的用户，等待越久条件越宽松。
+// 用户需要先通过BeginMatching进入匹配中状态，被其他用户领取后不会再加入等待池
+func (m *Matcher) RequestMatch(req MatchRequest) (*MatchAssignment, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// 更新状态
-	m.userStates[userID] = StateMatching
+	userID := req.UserID
+	self := WaitingUser{
+		UserID:      userID,
+		Tags:        normalizeTags(req.Tags),
+		Language:    strings.ToLower(strings.TrimSpace(req.Language)),
+		AvoidRecent: req.AvoidRecent,
+	}
+
+	// 双向屏蔽的用户（自己屏蔽的和屏蔽了自己的）和最近匹配过的用户
+	blocked := m.blockedUsers(userID)
+	recent := m.recentPartners(userID)
+
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		waitingUsers, err := m.queue.Waiting()
+		if err != nil {
+			log.Printf("Failed to get waiting users: %v", err)
+			return nil, false
+		}
+
+		// 已在等待池中时沿用加入时间
+		self.EnqueuedAt = time.Now()
+		for _, user := range waitingUsers {
+			if user.UserID == userID {
+				self.EnqueuedAt = user.EnqueuedAt
+				break
+			}
+		}
 
-	if len(m.waitingUsers) == 0 {
-		// 队列空，加入等待
-		m.waitingUsers = append(m.waitingUsers, userID)
-		return "", "", false // 未匹配
+		partnerID, common, ok := m.pickPartner(self, waitingUsers, blocked, recent)
+		if !ok {
+			break
+		}
+
+		// 原子地将双方移出队列并记录匹配结果
+		roomID := GenerateRoomID()
+		assignment := MatchAssignment{RoomID: roomID, PartnerID: partnerID, CommonTags: common}
+		claimed, err := m.queue.Claim(userID, partnerID, assignment, MatchAssignment{RoomID: roomID, PartnerID: userID, CommonTags: common})
+		if err != nil {
+			log.Printf("Failed to claim partner %s for user %s: %v", partnerID, userID, err)
+			return nil, false
+		}
+		if claimed {
+			m.pair(userID, partnerID)
+			return &assignment, true
+		}
+		// 对方已被其他请求领走或状态已过期（已移出等待池），或自己已被其他用户领取或已取消匹配，重试
+	}
+
+	// 没有合适的用户，加入等待
+	if err := m.queue.Enqueue(self); err != nil {
+		log.Printf("Failed to enqueue user %s: %v", userID, err)
+	}
+	return nil, false // 未匹配
+}
+
+// blockedUsers 获取用户屏蔽的和屏蔽了该用户的用户集合
+func (m *Matcher) blockedUsers(userID string) map[string]bool {
+	blocked := make(map[string]bool)
+	if m.storage == nil {
+		return blocked
+	}
+	users, err := m.storage.GetBlockedUsers(userID)
+	if err != nil {
+		log.Printf("Failed to get blocked users for %s: %v", userID, err)
 	}
+	blockers, err := m.storage.GetBlockedBy(userID)
+	if err != nil {
+		log.Printf("Failed to get blockers of %s: %v", userID, err)
+	}
+	for _, uid := range append(users, blockers...) {
+		blocked[uid] = true
+	}
+	return blocked
+}
 
-	// 随机选取一个等待用户
-	idx := rand.Intn(len(m.waitingUsers))
-	partnerID := m.waitingUsers[idx]
-	if partnerID == userID {
-		return "", "", false // 不能匹配自己
+// recentPartners 获取用户最近匹配过的用户集合
+func (m *Matcher) recentPartners(userID string) map[string]bool {
+	recent := make(map[string]bool)
+	partners, err := m.queue.RecentPartners(userID)
+	if err != nil {
+		log.Printf("Failed to get recent partners for %s: %v", userID, err)
+		return recent
+	}
+	for _, uid := range partners {
+		recent[uid] = true
 	}
+	return recent
+}
 
-	// 移除partner from 队列
-	m.waitingUsers = append(m.waitingUsers[:idx], m.waitingUsers[idx+1:]...)
+// pickPartner 从等待池中选出共同标签最多的可匹配用户，并列时随机选取
+// 跳过双向屏蔽的用户，任意一方要求时跳过最近匹配过的用户
+func (m *Matcher) pickPartner(self WaitingUser, waitingUsers []WaitingUser, blocked, recent map[string]bool) (string, []string, bool) {
+	now := time.Now()
+	best := -1
+	var candidates []string
+	commons := make(map[string][]string)
+	for _, user := range waitingUsers {
+		// 不能匹配自己
+		if user.UserID == self.UserID {
+			continue
+		}
+		if blocked[user.UserID] {
+			continue
+		}
+		if (self.AvoidRecent || user.AvoidRecent) && recent[user.UserID] {
+			continue
+		}
+		common := commonTags(self.Tags, user.Tags)
+		if !compatible(self, user, common, now) {
+			continue
+		}
+		switch {
+		case len(common) > best:
+			best = len(common)
+			candidates = []string{user.UserID}
+		case len(common) == best:
+			candidates = append(candidates, user.UserID)
+		}
+		commons[user.UserID] = common
+	}
+	if len(candidates) == 0 {
+		return "", nil, false
+	}
 
-	// 更新状态
-	m.userStates[userID] = StateChatting
-	m.userStates[partnerID] = StateChatting
+	partnerID := candidates[rand.Intn(len(candidates))]
+	return partnerID, commons[partnerID], true
+}
 
+// pair 记录两个用户的匹配统计，状态和匹配结果已在领取时记录（调用方需持有锁）
+func (m *Matcher) pair(userID, partnerID string) {
 	// 记录匹配次数
 	if m.storage != nil {
 		if err := m.storage.IncrementMatchCount(userID); err != nil {
@@ -68,60 +204,85 @@ func (m *Matcher) RequestMatch(userID string) (string, string, bool) {
 		}
 	}
 
-	// 生成roomID (简单用userID+partnerID)
-	roomID := userID + "-" + partnerID
-	return roomID, partnerID, true
+	// 记录最近匹配
+	if err := m.queue.RememberPartner(userID, partnerID); err != nil {
+		log.Printf("Failed to remember partner for user %s: %v", userID, err)
+	}
+	if err := m.queue.RememberPartner(partnerID, userID); err != nil {
+		log.Printf("Failed to remember partner for user %s: %v", partnerID, err)
+	}
 }
 
 func (m *Matcher) CheckUserState(userID string) *UserState {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if userState, ok := m.userStates[userID]; ok {
+	userState, ok, err := m.queue.GetState(userID)
+	if err != nil {
+		log.Printf("Failed to get state for user %s: %v", userID, err)
+		return nil
+	}
+	if ok {
 		return &userState
 	}
 	return nil
 }
 
-// CancelMatch 取消匹配（可选）
-func (m *Matcher) CancelMatch(userID string) {
+// GetAssignment 获取用户当前的匹配结果
+func (m *Matcher) GetAssignment(userID string) *MatchAssignment {
+	assignment, err := m.queue.GetAssignment(userID)
+	if err != nil {
+		log.Printf("Failed to get assignment for user %s: %v", userID, err)
+		return nil
+	}
+	return assignment
+}
+
+// CancelMatch 取消匹配，用户已在聊天中（已被其他用户领取）时返回false
+func (m *Matcher) CancelMatch(userID string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	for i, uid := range m.waitingUsers {
-		if uid == userID {
-			m.waitingUsers = append(m.waitingUsers[:i], m.waitingUsers[i+1:]...)
-			break
-		}
+	cancelled, err := m.queue.Cancel(userID)
+	if err != nil {
+		log.Printf("Failed to cancel matching for user %s: %v", userID, err)
+		return true
+	}
+	return cancelled
+}
+
+// ResetUser 清理用户状态（离开房间时调用）
+func (m *Matcher) ResetUser(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.queue.Reset(userID); err != nil {
+		log.Printf("Failed to reset user %s: %v", userID, err)
 	}
-	m.userStates[userID] = StateIdle
 }
 
-// MatchWithAI 与AI用户匹配
-func (m *Matcher) MatchWithAI(userID string) (string, string, bool) {
+// MatchWithAI 与使用指定人设的AI用户匹配，用户已被其他用户领取（不在等待池中）时返回false
+func (m *Matcher) MatchWithAI(userID string, persona *Persona) (string, string, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// 生成AI用户ID
+	// 生成AI用户ID（AI用户的状态不写入队列）
 	aiUserID := GenerateAIUserID()
+	roomID := GenerateRoomID()
 
-	// 更新状态
-	m.userStates[userID] = StateChatting
-	m.userStates[aiUserID] = StateChatting
+	// 原子地从等待池移除用户并记录匹配结果，避免覆盖真人刚领取的匹配
+	withdrawn, err := m.queue.Withdraw(userID, MatchAssignment{RoomID: roomID, PartnerID: aiUserID, Persona: persona.Info()})
+	if err != nil {
+		log.Printf("Failed to withdraw user %s from queue: %v", userID, err)
+		return "", "", false
+	}
+	if !withdrawn {
+		return "", "", false
+	}
 
-	// 记录匹配次数
+	// 记录匹配次数（AI用户不记录）
 	if m.storage != nil {
 		if err := m.storage.IncrementMatchCount(userID); err != nil {
 			log.Printf("Failed to increment match count for user %s: %v", userID, err)
 		}
-		// AI用户不记录匹配次数
 	}
-
-	// 从等待队列移除用户（如果在队列中）
-	m.waitingUsers = lo.Filter(m.waitingUsers, func(uid string, _ int) bool {
-		return uid != userID
-	})
-
-	// 生成roomID
-	roomID := userID + "-" + aiUserID
 	return roomID, aiUserID, true
 }
 
@@ -0,0 +1,397 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每个房间默认保留的消息条数
+const defaultMemoryMaxMessages = 1000
+
+// messageRing 固定容量的消息环形缓冲区
+type messageRing struct {
+	buf   []Message
+	start int // 最早一条消息的位置
+	size  int // 当前消息数量
+}
+
+func newMessageRing(capacity int) *messageRing {
+	return &messageRing{buf: make([]Message, capacity)}
+}
+
+// push 追加消息，缓冲区满时覆盖最早的消息并返回被覆盖的消息
+func (r *messageRing) push(msg Message) (Message, bool) {
+	if len(r.buf) == 0 {
+		return Message{}, false
+	}
+	if r.size < len(r.buf) {
+		r.buf[(r.start+r.size)%len(r.buf)] = msg
+		r.size++
+		return Message{}, false
+	}
+	evicted := r.buf[r.start]
+	r.buf[r.start] = msg
+	r.start = (r.start + 1) % len(r.buf)
+	return evicted, true
+}
+
+// latest 按时间顺序返回最近的limit条消息
+func (r *messageRing) latest(limit int) []Message {
+	if limit <= 0 || limit > r.size {
+		limit = r.size
+	}
+	messages := make([]Message, 0, limit)
+	for i := r.size - limit; i < r.size; i++ {
+		messages = append(messages, r.buf[(r.start+i)%len(r.buf)])
+	}
+	return messages
+}
+
+// find 查找仍保留在缓冲区中的消息
+func (r *messageRing) find(id string) (Message, bool) {
+	for i := 0; i < r.size; i++ {
+		if msg := r.buf[(r.start+i)%len(r.buf)]; msg.ID == id {
+			return msg, true
+		}
+	}
+	return Message{}, false
+}
+
+// MemoryStorage 内存存储实现（无需Redis，适用于本地开发和测试）
+type MemoryStorage struct {
+	mu          sync.RWMutex
+	maxMessages int
+	messages    map[string]*messageRing               // roomID -> 消息环
+	userRooms   map[string]map[string]struct{}        // userID -> 房间集合
+	stats       map[string]*UserMatchStats            // userID -> 匹配统计
+	sessions    map[string]*ChatSession               // roomID -> 会话记录
+	blocks      map[string]map[string]struct{}        // userID -> 屏蔽的用户集合
+	summaries   map[string]RoomSummary                // roomID -> AI对话摘要
+	receipts    map[string]map[string]*messageReceipt // roomID -> messageID -> 回执状态
+	clientIDs   map[string]map[string]Message         // roomID -> ClientID -> 已保存的消息，用于去重
+}
+
+// NewMemoryStorage 创建内存存储实例，maxMessages为每个房间保留的最大消息数
+func NewMemoryStorage(maxMessages int) Storage {
+	if maxMessages <= 0 {
+		maxMessages = defaultMemoryMaxMessages
+	}
+	return &MemoryStorage{
+		maxMessages: maxMessages,
+		messages:    make(map[string]*messageRing),
+		userRooms:   make(map[string]map[string]struct{}),
+		stats:       make(map[string]*UserMatchStats),
+		sessions:    make(map[string]*ChatSession),
+		blocks:      make(map[string]map[string]struct{}),
+		summaries:   make(map[string]RoomSummary),
+		receipts:    make(map[string]map[string]*messageReceipt),
+		clientIDs:   make(map[string]map[string]Message),
+	}
+}
+
+// addUserRoom 记录用户参与的房间（调用方需持有写锁）
+func (ms *MemoryStorage) addUserRoom(userID, roomID string) {
+	rooms, ok := ms.userRooms[userID]
+	if !ok {
+		rooms = make(map[string]struct{})
+		ms.userRooms[userID] = rooms
+	}
+	rooms[roomID] = struct{}{}
+}
+
+// SaveMessage 保存消息到内存
+func (ms *MemoryStorage) SaveMessage(message Message) error {
+	if message.RoomID == "" {
+		return fmt.Errorf("message room_id is required")
+	}
+
+	// 设置消息时间戳
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.pushMessage(message)
+	return nil
+}
+
+// SaveMessageDedup 保存消息，window内同一房间已保存过相同ClientID的消息时返回该消息
+func (ms *MemoryStorage) SaveMessageDedup(message Message, window time.Duration) (Message, bool, error) {
+	if message.ClientID == "" {
+		return message, false, ms.SaveMessage(message)
+	}
+	if message.RoomID == "" {
+		return message, false, fmt.Errorf("message room_id is required")
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	clientIDs, ok := ms.clientIDs[message.RoomID]
+	if !ok {
+		clientIDs = make(map[string]Message)
+		ms.clientIDs[message.RoomID] = clientIDs
+	}
+	// 清理已过去重窗口的记录
+	for clientID, saved := range clientIDs {
+		if message.Timestamp.Sub(saved.Timestamp) >= window {
+			delete(clientIDs, clientID)
+		}
+	}
+	if saved, ok := clientIDs[message.ClientID]; ok {
+		return saved, true, nil
+	}
+	clientIDs[message.ClientID] = message
+
+	ms.pushMessage(message)
+	return message, false, nil
+}
+
+// pushMessage 将消息追加到房间的消息环（调用方需持有写锁）
+func (ms *MemoryStorage) pushMessage(message Message) {
+	ring, ok := ms.messages[message.RoomID]
+	if !ok {
+		ring = newMessageRing(ms.maxMessages)
+		ms.messages[message.RoomID] = ring
+	}
+	// 被覆盖的消息不会再出现在聊天记录中，同时清理它的回执和去重记录
+	if evicted, ok := ring.push(message); ok {
+		delete(ms.receipts[message.RoomID], evicted.ID)
+		if saved, ok := ms.clientIDs[message.RoomID][evicted.ClientID]; ok && saved.ID == evicted.ID {
+			delete(ms.clientIDs[message.RoomID], evicted.ClientID)
+		}
+	}
+
+	// 为发送者添加房间记录
+	ms.addUserRoom(message.From, message.RoomID)
+}
+
+// GetChatHistory 获取聊天历史
+func (ms *MemoryStorage) GetChatHistory(roomID string, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = 100 // 默认限制100条
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	ring, ok := ms.messages[roomID]
+	if !ok {
+		return []Message{}, nil
+	}
+	messages := ring.latest(limit)
+	for i := range messages {
+		if receipt, ok := ms.receipts[roomID][messages[i].ID]; ok {
+			messages[i].DeliveredAt, messages[i].ReadAt = receipt.DeliveredAt, receipt.ReadAt
+		}
+	}
+	return messages, nil
+}
+
+// SaveReceipt 保存消息回执，消息需要仍保留在房间的消息环中
+func (ms *MemoryStorage) SaveReceipt(roomID, messageID, reader string, status ReceiptStatus, at time.Time) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ring, ok := ms.messages[roomID]
+	if !ok {
+		return false, nil
+	}
+	msg, ok := ring.find(messageID)
+	if !ok || msg.From == reader {
+		return false, nil
+	}
+
+	receipts, ok := ms.receipts[roomID]
+	if !ok {
+		receipts = make(map[string]*messageReceipt)
+		ms.receipts[roomID] = receipts
+	}
+	receipt, ok := receipts[messageID]
+	if !ok {
+		receipt = &messageReceipt{}
+		receipts[messageID] = receipt
+	}
+	receipt.apply(status, at)
+	return true, nil
+}
+
+// GetUserChatRooms 获取用户参与的聊天室列表
+func (ms *MemoryStorage) GetUserChatRooms(userID string) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	rooms := make([]string, 0, len(ms.userRooms[userID]))
+	for roomID := range ms.userRooms[userID] {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+// IncrementMatchCount 增加用户匹配次数
+func (ms *MemoryStorage) IncrementMatchCount(userID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	stats, ok := ms.stats[userID]
+	if !ok {
+		stats = &UserMatchStats{UserID: userID}
+		ms.stats[userID] = stats
+	}
+	stats.MatchCount++
+	stats.LastMatchAt = time.Now().Format(time.RFC3339)
+
+	return nil
+}
+
+// GetMatchStats 获取用户匹配统计
+func (ms *MemoryStorage) GetMatchStats(userID string) (*UserMatchStats, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	stats, ok := ms.stats[userID]
+	if !ok {
+		// 返回默认统计信息
+		return &UserMatchStats{
+			UserID:     userID,
+			MatchCount: 0,
+		}, nil
+	}
+
+	result := *stats
+	return &result, nil
+}
+
+// GetAllUserStats 获取所有用户统计（用于管理和调试）
+func (ms *MemoryStorage) GetAllUserStats() ([]UserMatchStats, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	stats := make([]UserMatchStats, 0, len(ms.stats))
+	for _, s := range ms.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].UserID < stats[j].UserID
+	})
+	return stats, nil
+}
+
+// CreateChatSession 创建聊天会话
+func (ms *MemoryStorage) CreateChatSession(roomID string, users []string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.sessions[roomID] = &ChatSession{
+		RoomID:  roomID,
+		Users:   append([]string(nil), users...),
+		StartAt: time.Now(),
+		Active:  true,
+	}
+
+	// 为所有用户添加房间记录
+	for _, userID := range users {
+		ms.addUserRoom(userID, roomID)
+	}
+
+	return nil
+}
+
+// GetRoomMembers 获取房间成员
+func (ms *MemoryStorage) GetRoomMembers(roomID string) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	session, ok := ms.sessions[roomID]
+	if !ok {
+		return []string{}, nil
+	}
+	return append([]string(nil), session.Users...), nil
+}
+
+// EndChatSession 结束聊天会话，清理房间的去重记录（聊天记录和回执保留，结束后仍可查询）
+func (ms *MemoryStorage) EndChatSession(roomID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	session, ok := ms.sessions[roomID]
+	if !ok {
+		return fmt.Errorf("chat session %s not found", roomID)
+	}
+	session.EndAt = time.Now()
+	session.Active = false
+	delete(ms.clientIDs, roomID)
+
+	return nil
+}
+
+// BlockUser 屏蔽用户
+func (ms *MemoryStorage) BlockUser(userID, blockedID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	blocked, ok := ms.blocks[userID]
+	if !ok {
+		blocked = make(map[string]struct{})
+		ms.blocks[userID] = blocked
+	}
+	blocked[blockedID] = struct{}{}
+	return nil
+}
+
+// GetBlockedUsers 获取用户屏蔽的用户列表
+func (ms *MemoryStorage) GetBlockedUsers(userID string) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	blocked := make([]string, 0, len(ms.blocks[userID]))
+	for blockedID := range ms.blocks[userID] {
+		blocked = append(blocked, blockedID)
+	}
+	sort.Strings(blocked)
+	return blocked, nil
+}
+
+// GetBlockedBy 获取屏蔽了该用户的用户列表
+func (ms *MemoryStorage) GetBlockedBy(userID string) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var blockers []string
+	for blockerID, blocked := range ms.blocks {
+		if _, ok := blocked[userID]; ok {
+			blockers = append(blockers, blockerID)
+		}
+	}
+	sort.Strings(blockers)
+	return blockers, nil
+}
+
+// SaveRoomSummary 保存房间的对话摘要
+func (ms *MemoryStorage) SaveRoomSummary(summary RoomSummary) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.summaries[summary.RoomID] = summary
+	return nil
+}
+
+// GetRoomSummary 获取房间的对话摘要
+func (ms *MemoryStorage) GetRoomSummary(roomID string) (*RoomSummary, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	summary, ok := ms.summaries[roomID]
+	if !ok {
+		return nil, nil
+	}
+	return &summary, nil
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 内置的默认AI人设
+const (
+	DefaultPersonaName = "counselor"
+
+	defaultPersonaTemperature = 0.7
+	defaultPersonaMaxTokens   = 200
+	defaultPacingMaxDelay     = 10 * time.Second
+)
+
+// Persona AI人设
+type Persona struct {
+	Name         string  `yaml:"name"`
+	SystemPrompt string  `yaml:"system_prompt"`
+	Greeting     string  `yaml:"greeting"`    // 固定的打招呼消息，为空时由模型根据人设生成
+	Temperature  float64 `yaml:"temperature"` // 默认0.7
+	MaxTokens    int     `yaml:"max_tokens"`  // 文本回复的最大token数，默认200（图片回复额外增加50）
+	Avatar       string  `yaml:"avatar"`
+	Pacing       Pacing  `yaml:"pacing"`
+}
+
+// Pacing 模拟真人打字速度的回复节奏：回复生成后按长度延迟发送（不再流式推送），
+// CharsPerSecond为0时不延迟
+type Pacing struct {
+	CharsPerSecond float64       `yaml:"chars_per_second"` // 每秒“打字”的字符数
+	MinDelay       time.Duration `yaml:"min_delay"`        // 最短延迟
+	MaxDelay       time.Duration `yaml:"max_delay"`        // 最长延迟，默认10秒
+}
+
+// Enabled 是否按回复长度延迟发送
+func (p Pacing) Enabled() bool {
+	return p.CharsPerSecond > 0
+}
+
+// Delay 回复从用户发送消息到送达的总时长，按字符数计算并限制在[MinDelay, MaxDelay]内
+func (p Pacing) Delay(reply string) time.Duration {
+	if !p.Enabled() {
+		return 0
+	}
+	delay := time.Duration(float64(len([]rune(reply))) / p.CharsPerSecond * float64(time.Second))
+	return min(max(delay, p.MinDelay), p.MaxDelay)
+}
+
+// PersonaInfo 返回给客户端的人设信息
+type PersonaInfo struct {
+	Name   string `json:"name"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// Info 返回给客户端的人设信息
+func (p *Persona) Info() *PersonaInfo {
+	return &PersonaInfo{Name: p.Name, Avatar: p.Avatar}
+}
+
+// PersonaRegistry AI人设注册表
+type PersonaRegistry struct {
+	mu          sync.RWMutex
+	personas    map[string]*Persona
+	defaultName string
+}
+
+// NewPersonaRegistry 创建只包含内置人设（心理咨询师）的注册表
+func NewPersonaRegistry() *PersonaRegistry {
+	r := &PersonaRegistry{
+		personas:    make(map[string]*Persona),
+		defaultName: DefaultPersonaName,
+	}
+	r.Register(Persona{
+		Name:         DefaultPersonaName,
+		SystemPrompt: RolePrompt,
+		Avatar:       "🧑‍⚕️",
+	})
+	return r
+}
+
+// LoadPersonas 从目录加载人设，每个YAML文件一个人设，与内置人设同名时覆盖内置人设
+func LoadPersonas(dir string) (*PersonaRegistry, error) {
+	r := NewPersonaRegistry()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read persona dir: %w", err)
+	}
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read persona %s: %w", path, err)
+		}
+		var persona Persona
+		if err := yaml.Unmarshal(data, &persona); err != nil {
+			return nil, fmt.Errorf("failed to parse persona %s: %w", path, err)
+		}
+		if persona.Name == "" {
+			persona.Name = strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		}
+		if persona.SystemPrompt == "" {
+			return nil, fmt.Errorf("persona %s: system_prompt is required", path)
+		}
+		r.Register(persona)
+	}
+	return r, nil
+}
+
+// Register 注册人设，未设置的参数使用默认值
+func (r *PersonaRegistry) Register(persona Persona) {
+	if persona.Temperature <= 0 {
+		persona.Temperature = defaultPersonaTemperature
+	}
+	if persona.MaxTokens <= 0 {
+		persona.MaxTokens = defaultPersonaMaxTokens
+	}
+	if persona.Pacing.MaxDelay <= 0 {
+		persona.Pacing.MaxDelay = defaultPacingMaxDelay
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.personas[persona.Name] = &persona
+}
+
+// SetDefault 设置未指定偏好时使用的人设
+func (r *PersonaRegistry) SetDefault(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.personas[name]; !ok {
+		return fmt.Errorf("unknown persona: %s", name)
+	}
+	r.defaultName = name
+	return nil
+}
+
+// Pick 按偏好选择人设，偏好为空或不存在时使用默认人设
+func (r *PersonaRegistry) Pick(preference string) *Persona {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if persona, ok := r.personas[preference]; ok {
+		return persona
+	}
+	return r.personas[r.defaultName]
+}
+
+// List 按名称返回所有人设
+func (r *PersonaRegistry) List() []*Persona {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	personas := make([]*Persona, 0, len(r.personas))
+	for _, persona := range r.personas {
+		personas = append(personas, persona)
+	}
+	sort.Slice(personas, func(i, j int) bool { return personas[i].Name < personas[j].Name })
+	return personas
+}
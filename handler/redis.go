@@ -3,7 +3,6 @@ package handler
 import (
 	"context"
 	"log"
-	"os"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -28,14 +27,6 @@ func NewRedisManager(config RedisConfig) *RedisManager {
 		config.Addr = "localhost:6379"
 	}
 
-	// 支持从环境变量读取配置
-	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
-		config.Addr = addr
-	}
-	if password := os.Getenv("REDIS_PASSWORD"); password != "" {
-		config.Password = password
-	}
-
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     config.Addr,
 		Password: config.Password,
@@ -0,0 +1,479 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisWaitingKey = "match:waiting" // 等待池（sorted set，score为加入时间）
+	matchStateTTL   = 24 * time.Hour  // 用户状态和匹配结果的过期时间，防止异常退出的用户残留
+	matchTicketTTL  = time.Hour       // 匹配票据的过期时间
+)
+
+// 匹配队列的Lua脚本，保证等待池、用户状态和匹配结果在多个实例间原子地修改
+var (
+	// beginMatchingScript 用户不在聊天中时设置为匹配中
+	// KEYS: 状态  ARGV: 过期秒数
+	beginMatchingScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == 'chatting' then
+	return 0
+end
+redis.call('SET', KEYS[1], 'matching', 'EX', ARGV[1])
+return 1
+`)
+
+	// enqueueScript 只有用户仍在匹配中时才加入等待池
+	// KEYS: 等待池, 状态  ARGV: 用户ID, 加入时间
+	enqueueScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) ~= 'matching' then
+	return 0
+end
+return redis.call('ZADD', KEYS[1], 'NX', ARGV[2], ARGV[1])
+`)
+
+	// cancelScript 用户不在聊天中时移出等待池并设置为空闲
+	// KEYS: 等待池, 状态  ARGV: userID, 过期秒数
+	cancelScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) == 'chatting' then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('SET', KEYS[2], 'idle', 'EX', ARGV[2])
+return 1
+`)
+
+	// claimScript 领取partner：user和partner都在匹配中且partner仍在等待池中时，移除双方并记录双方的状态和匹配结果；
+	// partner的状态已过期（实例崩溃或异常退出）时将其移出等待池
+	// KEYS: 等待池, user状态, partner状态, user匹配结果, partner匹配结果
+	// ARGV: userID, partnerID, user匹配结果, partner匹配结果, 过期秒数
+	claimScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) ~= 'matching' then
+	return 0
+end
+if redis.call('ZREM', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+if redis.call('GET', KEYS[3]) ~= 'matching' then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('SET', KEYS[2], 'chatting', 'EX', ARGV[5])
+redis.call('SET', KEYS[3], 'chatting', 'EX', ARGV[5])
+redis.call('SET', KEYS[4], ARGV[3], 'EX', ARGV[5])
+redis.call('SET', KEYS[5], ARGV[4], 'EX', ARGV[5])
+return 1
+`)
+
+	// withdrawScript 匹配中的用户仍在等待池中时移出，并记录状态和匹配结果
+	// KEYS: 等待池, 状态, 匹配结果  ARGV: userID, 匹配结果, 过期秒数
+	withdrawScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) ~= 'matching' then
+	return 0
+end
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('SET', KEYS[2], 'chatting', 'EX', ARGV[3])
+redis.call('SET', KEYS[3], ARGV[2], 'EX', ARGV[3])
+return 1
+`)
+
+	// createTicketScript 用户最近的票据仍在等待时返回该票据，否则保存新票据
+	// KEYS: 用户票据, 新票据  ARGV: 新票据ID, 新票据, 过期秒数
+	createTicketScript = redis.NewScript(`
+local previous = redis.call('GET', KEYS[1])
+if previous then
+	local data = redis.call('GET', 'match:ticket:' .. previous)
+	if data and cjson.decode(data)['status'] == 'queued' then
+		return data
+	end
+end
+redis.call('SET', KEYS[2], ARGV[2], 'EX', ARGV[3])
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[3])
+return false
+`)
+
+	// saveResumeScript previous为空或当前会话的令牌为previous时保存会话
+	// KEYS: 会话  ARGV: previous, 会话, 过期毫秒数
+	saveResumeScript = redis.NewScript(`
+if ARGV[1] ~= '' then
+	local current = redis.call('GET', KEYS[1])
+	if not current or cjson.decode(current)['token'] ~= ARGV[1] then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+	// clearResumeScript 会话不存在或令牌为token时删除会话
+	// KEYS: 会话  ARGV: token
+	clearResumeScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and cjson.decode(current)['token'] ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+	// updateTicketScript 票据当前状态为from时保存票据
+	// KEYS: 票据  ARGV: from, 票据, 过期秒数
+	updateTicketScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current or cjson.decode(current)['status'] ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'EX', ARGV[3])
+return 1
+`)
+)
+
+// RedisMatchQueue 基于Redis的匹配队列，多个服务实例共享同一个等待池
+type RedisMatchQueue struct {
+	redis *RedisManager
+}
+
+// NewRedisMatchQueue 创建Redis匹配队列
+func NewRedisMatchQueue(redisManager *RedisManager) MatchQueue {
+	return &RedisMatchQueue{
+		redis: redisManager,
+	}
+}
+
+func (q *RedisMatchQueue) getStateKey(userID string) string {
+	return fmt.Sprintf("match:state:%s", userID)
+}
+
+func (q *RedisMatchQueue) getProfileKey(userID string) string {
+	return fmt.Sprintf("match:profile:%s", userID)
+}
+
+func (q *RedisMatchQueue) getAssignmentKey(userID string) string {
+	return fmt.Sprintf("match:assignment:%s", userID)
+}
+
+func (q *RedisMatchQueue) getRecentKey(userID string) string {
+	return fmt.Sprintf("match:recent:%s", userID)
+}
+
+func (q *RedisMatchQueue) getTicketKey(ticketID string) string {
+	return fmt.Sprintf("match:ticket:%s", ticketID)
+}
+
+func (q *RedisMatchQueue) getUserTicketKey(userID string) string {
+	return fmt.Sprintf("match:user_ticket:%s", userID)
+}
+
+func (q *RedisMatchQueue) getResumeKey(userID string) string {
+	return fmt.Sprintf("match:resume:%s", userID)
+}
+
+// BeginMatching 将用户状态设置为匹配中
+func (q *RedisMatchQueue) BeginMatching(userID string) (bool, error) {
+	ok, err := beginMatchingScript.Run(q.redis.ctx, q.redis.client, []string{q.getStateKey(userID)}, int(matchStateTTL.Seconds())).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin matching: %w", err)
+	}
+	return ok == 1, nil
+}
+
+// Enqueue 将用户加入等待池
+func (q *RedisMatchQueue) Enqueue(user WaitingUser) error {
+	if user.EnqueuedAt.IsZero() {
+		user.EnqueuedAt = time.Now()
+	}
+
+	// 先保存标签和语言，再加入等待池，保证其他实例读取等待池时资料已存在
+	profile, err := json.Marshal(WaitingUser{Tags: user.Tags, Language: user.Language, AvoidRecent: user.AvoidRecent})
+	if err != nil {
+		return fmt.Errorf("failed to serialize profile: %w", err)
+	}
+	if err := q.redis.client.Set(q.redis.ctx, q.getProfileKey(user.UserID), profile, matchStateTTL).Err(); err != nil {
+		return fmt.Errorf("failed to save profile: %w", err)
+	}
+
+	keys := []string{redisWaitingKey, q.getStateKey(user.UserID)}
+	err = enqueueScript.Run(q.redis.ctx, q.redis.client, keys, user.UserID, user.EnqueuedAt.UnixMilli()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to enqueue user: %w", err)
+	}
+	return nil
+}
+
+// Cancel 将匹配中的用户移出等待池并设置为空闲
+func (q *RedisMatchQueue) Cancel(userID string) (bool, error) {
+	keys := []string{redisWaitingKey, q.getStateKey(userID)}
+	cancelled, err := cancelScript.Run(q.redis.ctx, q.redis.client, keys, userID, int(matchStateTTL.Seconds())).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel matching: %w", err)
+	}
+	return cancelled == 1, nil
+}
+
+// Waiting 按加入顺序返回等待池中的用户
+func (q *RedisMatchQueue) Waiting() ([]WaitingUser, error) {
+	members, err := q.redis.client.ZRangeWithScores(q.redis.ctx, redisWaitingKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get waiting users: %w", err)
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	users := make([]WaitingUser, len(members))
+	profileKeys := make([]string, len(members))
+	for i, member := range members {
+		userID, _ := member.Member.(string)
+		users[i] = WaitingUser{
+			UserID:     userID,
+			EnqueuedAt: time.UnixMilli(int64(member.Score)),
+		}
+		profileKeys[i] = q.getProfileKey(userID)
+	}
+
+	// 批量读取标签和语言
+	profiles, err := q.redis.client.MGet(q.redis.ctx, profileKeys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get waiting user profiles: %w", err)
+	}
+	for i, raw := range profiles {
+		data, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var profile WaitingUser
+		if err := json.Unmarshal([]byte(data), &profile); err == nil {
+			users[i].Tags = profile.Tags
+			users[i].Language = profile.Language
+			users[i].AvoidRecent = profile.AvoidRecent
+		}
+	}
+	return users, nil
+}
+
+// Position 返回用户在等待池中的位置（按加入时间排序）
+func (q *RedisMatchQueue) Position(userID string) (int, error) {
+	rank, err := q.redis.client.ZRank(q.redis.ctx, redisWaitingKey, userID).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get queue position: %w", err)
+	}
+	return int(rank) + 1, nil
+}
+
+// Claim 领取等待中的partner
+func (q *RedisMatchQueue) Claim(userID, partnerID string, assignment, partnerAssignment MatchAssignment) (bool, error) {
+	data, err := json.Marshal(assignment)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize assignment: %w", err)
+	}
+	partnerData, err := json.Marshal(partnerAssignment)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize assignment: %w", err)
+	}
+
+	keys := []string{
+		redisWaitingKey,
+		q.getStateKey(userID), q.getStateKey(partnerID),
+		q.getAssignmentKey(userID), q.getAssignmentKey(partnerID),
+	}
+	claimed, err := claimScript.Run(q.redis.ctx, q.redis.client, keys, userID, partnerID, data, partnerData, int(matchStateTTL.Seconds())).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim partner: %w", err)
+	}
+	return claimed == 1, nil
+}
+
+// Withdraw 将匹配中的用户移出等待池并记录匹配结果
+func (q *RedisMatchQueue) Withdraw(userID string, assignment MatchAssignment) (bool, error) {
+	data, err := json.Marshal(assignment)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize assignment: %w", err)
+	}
+
+	keys := []string{redisWaitingKey, q.getStateKey(userID), q.getAssignmentKey(userID)}
+	withdrawn, err := withdrawScript.Run(q.redis.ctx, q.redis.client, keys, userID, data, int(matchStateTTL.Seconds())).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to withdraw user: %w", err)
+	}
+	return withdrawn == 1, nil
+}
+
+// GetState 获取用户状态
+func (q *RedisMatchQueue) GetState(userID string) (UserState, bool, error) {
+	state, err := q.redis.client.Get(q.redis.ctx, q.getStateKey(userID)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get user state: %w", err)
+	}
+	return UserState(state), true, nil
+}
+
+// GetAssignment 获取匹配结果，没有匹配结果时返回nil
+func (q *RedisMatchQueue) GetAssignment(userID string) (*MatchAssignment, error) {
+	data, err := q.redis.client.Get(q.redis.ctx, q.getAssignmentKey(userID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get assignment: %w", err)
+	}
+
+	var assignment MatchAssignment
+	if err := json.Unmarshal(data, &assignment); err != nil {
+		return nil, fmt.Errorf("failed to parse assignment: %w", err)
+	}
+	return &assignment, nil
+}
+
+// RememberPartner 记录最近匹配过的用户（sorted set，score为匹配时间）
+func (q *RedisMatchQueue) RememberPartner(userID, partnerID string) error {
+	key := q.getRecentKey(userID)
+	pipe := q.redis.client.TxPipeline()
+	pipe.ZAdd(q.redis.ctx, key, &redis.Z{Score: float64(time.Now().UnixMilli()), Member: partnerID})
+	pipe.Expire(q.redis.ctx, key, recentPartnerWindow)
+	if _, err := pipe.Exec(q.redis.ctx); err != nil {
+		return fmt.Errorf("failed to remember partner: %w", err)
+	}
+	return nil
+}
+
+// RecentPartners 返回最近匹配过的用户
+func (q *RedisMatchQueue) RecentPartners(userID string) ([]string, error) {
+	cutoff := time.Now().Add(-recentPartnerWindow).UnixMilli()
+	partners, err := q.redis.client.ZRangeByScore(q.redis.ctx, q.getRecentKey(userID), &redis.ZRangeBy{
+		Min: fmt.Sprintf("%d", cutoff),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recent partners: %w", err)
+	}
+	return partners, nil
+}
+
+// CreateTicket 用户没有等待中的票据时保存新票据
+func (q *RedisMatchQueue) CreateTicket(ticket MatchTicket) (*MatchTicket, bool, error) {
+	data, err := json.Marshal(ticket)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to serialize ticket: %w", err)
+	}
+	keys := []string{q.getUserTicketKey(ticket.UserID), q.getTicketKey(ticket.ID)}
+	existing, err := createTicketScript.Run(q.redis.ctx, q.redis.client, keys, ticket.ID, data, int(matchTicketTTL.Seconds())).Text()
+	if err == redis.Nil {
+		return &ticket, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create ticket: %w", err)
+	}
+
+	var queued MatchTicket
+	if err := json.Unmarshal([]byte(existing), &queued); err != nil {
+		return nil, false, fmt.Errorf("failed to parse ticket: %w", err)
+	}
+	return &queued, false, nil
+}
+
+// UpdateTicket 票据当前状态为from时保存票据
+func (q *RedisMatchQueue) UpdateTicket(ticket MatchTicket, from TicketStatus) (bool, error) {
+	data, err := json.Marshal(ticket)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize ticket: %w", err)
+	}
+	updated, err := updateTicketScript.Run(q.redis.ctx, q.redis.client, []string{q.getTicketKey(ticket.ID)}, string(from), data, int(matchTicketTTL.Seconds())).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to update ticket: %w", err)
+	}
+	return updated == 1, nil
+}
+
+// GetTicket 获取匹配票据，不存在时返回nil
+func (q *RedisMatchQueue) GetTicket(ticketID string) (*MatchTicket, error) {
+	data, err := q.redis.client.Get(q.redis.ctx, q.getTicketKey(ticketID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ticket: %w", err)
+	}
+
+	var ticket MatchTicket
+	if err := json.Unmarshal(data, &ticket); err != nil {
+		return nil, fmt.Errorf("failed to parse ticket: %w", err)
+	}
+	return &ticket, nil
+}
+
+// GetUserTicket 获取用户最近的匹配票据，不存在时返回nil
+func (q *RedisMatchQueue) GetUserTicket(userID string) (*MatchTicket, error) {
+	ticketID, err := q.redis.client.Get(q.redis.ctx, q.getUserTicketKey(userID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user ticket: %w", err)
+	}
+	return q.GetTicket(ticketID)
+}
+
+// SaveResume 保存用户的会话，断线后的会话在宽限期结束时过期
+func (q *RedisMatchQueue) SaveResume(userID string, session ResumeSession, previous string) (bool, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize resume session: %w", err)
+	}
+	ttl := matchStateTTL
+	if !session.Deadline.IsZero() {
+		ttl = max(time.Until(session.Deadline), time.Millisecond)
+	}
+	saved, err := saveResumeScript.Run(q.redis.ctx, q.redis.client, []string{q.getResumeKey(userID)}, previous, data, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to save resume session: %w", err)
+	}
+	return saved == 1, nil
+}
+
+// GetResume 获取用户的会话，不存在或宽限期已结束时返回nil
+func (q *RedisMatchQueue) GetResume(userID string) (*ResumeSession, error) {
+	data, err := q.redis.client.Get(q.redis.ctx, q.getResumeKey(userID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get resume session: %w", err)
+	}
+
+	var session ResumeSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse resume session: %w", err)
+	}
+	if session.expired(time.Now()) {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// ClearResume 删除令牌为token的会话
+func (q *RedisMatchQueue) ClearResume(userID, token string) (bool, error) {
+	cleared, err := clearResumeScript.Run(q.redis.ctx, q.redis.client, []string{q.getResumeKey(userID)}, token).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to clear resume session: %w", err)
+	}
+	return cleared == 1, nil
+}
+
+// Reset 清除用户状态和匹配结果
+func (q *RedisMatchQueue) Reset(userID string) error {
+	if err := q.redis.client.Del(q.redis.ctx, q.getStateKey(userID), q.getAssignmentKey(userID), q.getProfileKey(userID)).Err(); err != nil {
+		return fmt.Errorf("failed to reset user: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisRoomChannelPrefix = "room:events:"
+	subscribeTimeout       = 5 * time.Second // 等待Redis确认订阅的时间
+)
+
+// RedisRoomTransport 基于Redis pub/sub的传输层，每个房间对应一个频道，
+// 匹配的两个用户连接到不同实例时也能互相收到消息。
+// 每个实例只使用一个订阅连接，按房间增减频道，收到的事件按RoomID分发给本实例的订阅者
+type RedisRoomTransport struct {
+	redis *RedisManager
+
+	mu       sync.Mutex
+	pubsub   *redis.PubSub                      // 共享的订阅连接，第一次订阅时创建
+	nextID   int                                // 下一个订阅者ID
+	handlers map[string]map[int]func(RoomEvent) // roomID -> 订阅者
+	pending  map[string]chan struct{}           // 频道 -> 等待订阅确认
+}
+
+// NewRedisRoomTransport 创建Redis传输层
+func NewRedisRoomTransport(redisManager *RedisManager) RoomTransport {
+	return &RedisRoomTransport{
+		redis:    redisManager,
+		handlers: make(map[string]map[int]func(RoomEvent)),
+		pending:  make(map[string]chan struct{}),
+	}
+}
+
+func (t *RedisRoomTransport) getChannel(roomID string) string {
+	return redisRoomChannelPrefix + roomID
+}
+
+// Publish 发布房间事件到房间频道
+func (t *RedisRoomTransport) Publish(event RoomEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize room event: %w", err)
+	}
+	if err := t.redis.client.Publish(t.redis.ctx, t.getChannel(event.RoomID), data).Err(); err != nil {
+		return fmt.Errorf("failed to publish room event: %w", err)
+	}
+	return nil
+}
+
+// Subscribe 订阅房间频道，房间的第一个订阅者在共享连接上增加频道并等待订阅确认
+func (t *RedisRoomTransport) Subscribe(roomID string, handler func(RoomEvent)) (func(), error) {
+	channel := t.getChannel(roomID)
+
+	t.mu.Lock()
+	t.nextID++
+	id := t.nextID
+	var confirmed chan struct{}
+	if _, ok := t.handlers[roomID]; !ok {
+		t.handlers[roomID] = make(map[int]func(RoomEvent))
+		confirmed = make(chan struct{})
+		t.pending[channel] = confirmed
+
+		var err error
+		if t.pubsub == nil {
+			t.pubsub = t.redis.client.Subscribe(t.redis.ctx, channel)
+			go t.receive(t.pubsub.ChannelWithSubscriptions(t.redis.ctx, 100))
+		} else {
+			err = t.pubsub.Subscribe(t.redis.ctx, channel)
+		}
+		if err != nil {
+			delete(t.handlers, roomID)
+			delete(t.pending, channel)
+			t.mu.Unlock()
+			return nil, fmt.Errorf("failed to subscribe room %s: %w", roomID, err)
+		}
+	}
+	t.handlers[roomID][id] = handler
+	t.mu.Unlock()
+
+	unsubscribe := func() { t.unsubscribe(roomID, id) }
+
+	// 等待订阅确认，避免丢失订阅后立即发布的消息
+	if confirmed != nil {
+		select {
+		case <-confirmed:
+		case <-time.After(subscribeTimeout):
+			unsubscribe()
+			return nil, fmt.Errorf("failed to subscribe room %s: confirmation timed out", roomID)
+		}
+	}
+	return unsubscribe, nil
+}
+
+// unsubscribe 移除订阅者，房间没有订阅者时从共享连接上移除频道
+func (t *RedisRoomTransport) unsubscribe(roomID string, id int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	handlers, ok := t.handlers[roomID]
+	if !ok {
+		return
+	}
+	delete(handlers, id)
+	if len(handlers) > 0 {
+		return
+	}
+	delete(t.handlers, roomID)
+	delete(t.pending, t.getChannel(roomID))
+	if err := t.pubsub.Unsubscribe(t.redis.ctx, t.getChannel(roomID)); err != nil {
+		log.Printf("Failed to unsubscribe room %s: %v", roomID, err)
+	}
+}
+
+// receive 读取共享订阅连接，确认订阅并将房间事件分发给订阅者
+func (t *RedisRoomTransport) receive(ch <-chan interface{}) {
+	for msg := range ch {
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind != "subscribe" {
+				continue
+			}
+			t.mu.Lock()
+			if confirmed, ok := t.pending[msg.Channel]; ok {
+				close(confirmed)
+				delete(t.pending, msg.Channel)
+			}
+			t.mu.Unlock()
+
+		case *redis.Message:
+			var event RoomEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("Failed to parse room event: %v", err)
+				continue
+			}
+			if event.RoomID == "" {
+				event.RoomID = strings.TrimPrefix(msg.Channel, redisRoomChannelPrefix)
+			}
+
+			t.mu.Lock()
+			handlers := make([]func(RoomEvent), 0, len(t.handlers[event.RoomID]))
+			for _, handler := range t.handlers[event.RoomID] {
+				handlers = append(handlers, handler)
+			}
+			t.mu.Unlock()
+
+			for _, handler := range handlers {
+				handler(event)
+			}
+		}
+	}
+}
@@ -3,22 +3,63 @@ package handler
 import (
 	"context"
 	"log"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// 默认的AI打招呼延迟
+const defaultAIGreetingDelay = 500 * time.Millisecond
+
+// 客户端消息ID的默认去重窗口和最大长度
+const (
+	defaultDedupeWindow = 5 * time.Minute
+	maxClientIDLength   = 64
+)
+
+// 恢复会话时最多补发的消息数
+const maxReplayMessages = 100
+
 type RoomManager struct {
-	rooms   map[string]*Room
-	mu      sync.Mutex
-	storage Storage // 添加存储接口
+	rooms     map[string]*Room
+	mu        sync.Mutex
+	storage   Storage          // 添加存储接口
+	transport RoomTransport    // 房间消息传输层（进程内或跨实例）
+	personas  *PersonaRegistry // AI人设
+	config    RoomConfig
 }
 
-func NewRoomManager(storage Storage) *RoomManager {
+// RoomConfig 房间配置
+type RoomConfig struct {
+	AIGreetingDelay time.Duration    // AI房间创建后发送打招呼消息前的等待时间，默认500毫秒
+	AIReplyTimeout  time.Duration    // 单次AI回复的超时时间，默认60秒
+	DedupeWindow    time.Duration    // 相同客户端消息ID只保存一次的时间窗口，默认5分钟
+	ResumeGrace     time.Duration    // 连接意外断开后保留用户位置的时间，期间可以恢复会话；为0时断线即离开房间
+	Personas        *PersonaRegistry // AI人设，为nil时只使用内置人设
+}
+
+func NewRoomManager(storage Storage, transport RoomTransport, config RoomConfig) *RoomManager {
+	if transport == nil {
+		transport = NewLocalRoomTransport()
+	}
+	if config.AIGreetingDelay <= 0 {
+		config.AIGreetingDelay = defaultAIGreetingDelay
+	}
+	if config.DedupeWindow <= 0 {
+		config.DedupeWindow = defaultDedupeWindow
+	}
+	personas := config.Personas
+	if personas == nil {
+		personas = NewPersonaRegistry()
+	}
 	return &RoomManager{
-		rooms:   make(map[string]*Room),
-		storage: storage,
+		rooms:     make(map[string]*Room),
+		storage:   storage,
+		transport: transport,
+		personas:  personas,
+		config:    config,
 	}
 }
 
@@ -26,35 +67,117 @@ func NewRoomManager(storage Storage) *RoomManager {
 func (rm *RoomManager) CreateRoom(roomID string, user1, user2 string) *Room {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
+	room := rm.openRoom(roomID, user1, user2)
+
+	// 创建聊天会话记录
+	if rm.storage != nil {
+		users := []string{user1, user2}
+		if err := rm.storage.CreateChatSession(roomID, users); err != nil {
+			log.Printf("Failed to create chat session in storage: %v", err)
+		}
+	}
+
+	return room
+}
+
+// openRoom 创建真人房间并订阅房间事件（调用方需持有锁）
+func (rm *RoomManager) openRoom(roomID string, user1, user2 string) *Room {
 	room := &Room{
 		ID:      roomID,
 		Users:   make(map[string]*User),
 		MsgChan: make(chan Message),
+		members: []string{user1, user2},
 	}
 	room.Users[user1] = &User{ID: user1, Type: UserTypeHuman}
 	room.Users[user2] = &User{ID: user2, Type: UserTypeHuman}
 	rm.rooms[roomID] = room
 
-	// 创建聊天会话记录
-	if rm.storage != nil {
-		users := []string{user1, user2}
-		if err := rm.storage.CreateChatSession(roomID, users); err != nil {
-			log.Printf("Failed to create chat session in storage: %v", err)
-		}
+	unsubscribe, err := rm.transport.Subscribe(roomID, func(event RoomEvent) {
+		rm.handleRoomEvent(room, event)
+	})
+	if err != nil {
+		log.Printf("Failed to subscribe room %s: %v", roomID, err)
+	} else {
+		room.unsubscribe = unsubscribe
 	}
 
 	go room.Run() // 启动房间消息循环
 	return room
 }
 
-// CreateAIRoom 创建包含AI用户的房间
-func (rm *RoomManager) CreateAIRoom(roomID string, humanUser, aiUser string) *Room {
+// attachRoom 在本实例上创建其他实例已匹配好的房间副本（调用方需持有锁）
+func (rm *RoomManager) attachRoom(roomID, userID string) (*Room, bool) {
+	assignment := matcher.GetAssignment(userID)
+	if assignment == nil || assignment.RoomID != roomID || IsAIUser(assignment.PartnerID) {
+		return nil, false
+	}
+	log.Printf("Attaching room [%s] matched on another instance", roomID)
+	return rm.openRoom(roomID, userID, assignment.PartnerID), true
+}
+
+// handleRoomEvent 处理传输层转发的房间事件
+func (rm *RoomManager) handleRoomEvent(room *Room, event RoomEvent) {
+	switch {
+	case event.Message != nil:
+		room.deliver(*event.Message)
+	case event.Left != "":
+		// 只处理连接在其他实例上的用户，本实例的用户已在cleanupUser中处理
+		rm.mu.Lock()
+		user, ok := room.user(event.Left)
+		rm.mu.Unlock()
+		if ok && user.Conn() == nil {
+			rm.removeUser(room, event.Left)
+		}
+	}
+}
+
+// publish 发布聊天消息：AI房间只在本实例内处理，其他房间通过传输层转发
+func (rm *RoomManager) publish(room *Room, msg Message) {
+	if room.withAI {
+		room.deliver(msg)
+		return
+	}
+	if err := rm.transport.Publish(RoomEvent{RoomID: room.ID, Message: &msg}); err != nil {
+		log.Printf("Failed to publish message to room %s: %v", room.ID, err)
+		room.deliver(msg) // 退回到本实例内广播
+	}
+}
+
+// deliver 将消息投递到房间消息循环，房间关闭后丢弃
+func (r *Room) deliver(msg Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.MsgChan <- msg
+}
+
+// close 关闭房间消息循环并取消订阅
+func (r *Room) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.unsubscribe != nil {
+		r.unsubscribe()
+	}
+	close(r.MsgChan)
+}
+
+// CreateAIRoom 创建包含AI用户的房间，AI使用指定的人设
+func (rm *RoomManager) CreateAIRoom(roomID string, humanUser, aiUser string, persona *Persona) *Room {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 	room := &Room{
 		ID:      roomID,
 		Users:   make(map[string]*User),
 		MsgChan: make(chan Message),
+		withAI:  true,
+		persona: persona,
+		members: []string{humanUser, aiUser},
 	}
 	room.Users[humanUser] = &User{ID: humanUser, Type: UserTypeHuman}
 	room.Users[aiUser] = &User{ID: aiUser, Type: UserTypeAI}
@@ -68,7 +191,7 @@ func (rm *RoomManager) CreateAIRoom(roomID string, humanUser, aiUser string) *Ro
 		}
 	}
 
-	go room.RunWithAI(matcher.GetAIClient()) // 启动AI房间消息循环
+	go room.RunWithAI(matcher.GetAIClient(), rm.config.AIReplyTimeout) // 启动AI房间消息循环
 
 	// AI主动发起打招呼
 	go rm.sendAIGreeting(room, aiUser)
@@ -76,12 +199,39 @@ func (rm *RoomManager) CreateAIRoom(roomID string, humanUser, aiUser string) *Ro
 	return room
 }
 
+// user 返回房间中的用户，并发安全
+func (r *Room) user(userID string) (*User, bool) {
+	r.usersMu.RLock()
+	defer r.usersMu.RUnlock()
+	user, ok := r.Users[userID]
+	return user, ok
+}
+
+// users 返回房间中用户的快照，广播时遍历快照，避免与用户离开时的删除并发访问map
+func (r *Room) users() []*User {
+	r.usersMu.RLock()
+	defer r.usersMu.RUnlock()
+	users := make([]*User, 0, len(r.Users))
+	for _, user := range r.Users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// deleteUser 将用户移出房间，返回剩余的用户
+func (r *Room) deleteUser(userID string) []*User {
+	r.usersMu.Lock()
+	delete(r.Users, userID)
+	r.usersMu.Unlock()
+	return r.users()
+}
+
 // Run 房间消息广播循环
 func (r *Room) Run() {
 	for msg := range r.MsgChan {
-		for _, user := range r.Users {
-			if user.ID != msg.From && user.Conn != nil {
-				if err := user.Conn.WriteJSON(msg); err != nil {
+		for _, user := range r.users() {
+			if user.ID != msg.From && user.Conn() != nil {
+				if err := user.Send(msg); err != nil {
 					log.Printf("Error writing to %s: %v", user.ID, err)
 				}
 			}
@@ -89,158 +239,512 @@ func (r *Room) Run() {
 	}
 }
 
-// RunWithAI 带AI用户的房间消息广播循环
-func (r *Room) RunWithAI(aiClient *AIClient) {
+// RunWithAI 带AI用户的房间消息广播循环，人类用户的消息交给AI回复工作协程按顺序回复，
+// 房间关闭时取消正在生成的回复
+func (r *Room) RunWithAI(aiClient *AIClient, replyTimeout time.Duration) {
+	var worker *aiWorker
+	if aiClient != nil {
+		worker = newAIWorker(r, aiClient, replyTimeout)
+		defer worker.stop()
+		go worker.run()
+	}
+
 	for msg := range r.MsgChan {
 		// 广播消息给所有用户
-		for _, user := range r.Users {
-			if user.ID != msg.From && user.Conn != nil {
-				if err := user.Conn.WriteJSON(msg); err != nil {
+		for _, user := range r.users() {
+			if user.ID != msg.From && user.Conn() != nil {
+				if err := user.Send(msg); err != nil {
 					log.Printf("Error writing to %s: %v", user.ID, err)
 				}
 			}
 		}
 
-		// 如果消息来自人类用户，且房间中有AI用户，则生成AI回复
-		if !IsAIUser(msg.From) && aiClient != nil {
-			go r.generateAIResponse(msg, aiClient)
+		// 如果消息来自人类用户，且房间中有AI用户，则标记已读并生成AI回复（临时事件和回执不回复）
+		if !IsAIUser(msg.From) && msg.Type != MessageTypeEvent && msg.Type != MessageTypeReceipt && worker != nil {
+			r.markReadByAI(msg)
+			worker.enqueue(msg)
 		}
 	}
 }
 
-// generateAIResponse 生成AI回复
-func (r *Room) generateAIResponse(userMsg Message, aiClient *AIClient) {
-	// 找到AI用户
-	var aiUserID string
-	for _, user := range r.Users {
+// aiUserID 返回房间中的AI用户ID，没有AI用户时返回空字符串
+func (r *Room) aiUserID() string {
+	for _, user := range r.users() {
 		if user.Type == UserTypeAI {
-			aiUserID = user.ID
-			break
+			return user.ID
 		}
 	}
+	return ""
+}
 
+// markReadByAI AI收到消息后立即回执已读
+func (r *Room) markReadByAI(msg Message) {
+	aiUserID := r.aiUserID()
 	if aiUserID == "" {
-		log.Printf("No AI user found in room %s", r.ID)
 		return
 	}
-
-	// 使用AI处理不同类型的消息，并提供上下文支持
-	ctx := context.Background()
-	var aiResponse string
-	var err error
-
-	// 使用带上下文的处理方法
-	aiResponse, err = aiClient.HandleMessageWithContext(ctx, userMsg, storage, r.ID)
-
-	if err != nil {
-		log.Printf("AI response failed: %v", err)
-		// 根据消息类型发送不同的错误消息
-		switch userMsg.Type {
-		case "image":
-			aiResponse = "我看到你发送了一张图片！不过我暂时无法分析图片内容，但我很乐意和你聊聊其他话题。"
-		default:
-			aiResponse = "抱歉，我现在无法回复您的消息。"
+	now := time.Now()
+	if storage != nil {
+		if _, err := storage.SaveReceipt(r.ID, msg.ID, aiUserID, ReceiptRead, now); err != nil {
+			log.Printf("Failed to save receipt for message %s: %v", msg.ID, err)
 		}
 	}
+	r.sendToHumans(Message{ID: msg.ID, From: aiUserID, RoomID: r.ID, Timestamp: now, Type: MessageTypeReceipt, Receipt: ReceiptRead})
+}
 
-	// 创建AI回复消息
-	aiMsg := Message{
-		ID:        GenerateMessageID(),
+// sendEvent 向人类用户发送AI的临时事件（如正在输入）
+func (r *Room) sendEvent(aiUserID string, event EventType) {
+	r.sendToHumans(Message{
 		From:      aiUserID,
-		Content:   aiResponse,
-		Type:      "text", // AI回复始终是文本类型
+		Type:      MessageTypeEvent,
+		Event:     event,
 		Timestamp: time.Now(),
 		RoomID:    r.ID,
+	})
+}
+
+// sendToHumans 将AI消息发送给房间中的人类用户
+func (r *Room) sendToHumans(msg Message) {
+	for _, user := range r.users() {
+		if user.Type == UserTypeHuman && user.Conn() != nil {
+			if err := user.Send(msg); err != nil {
+				log.Printf("Error writing AI message to %s: %v", user.ID, err)
+			}
+		}
 	}
+}
 
-	// 发送AI回复给人类用户
-	for _, user := range r.Users {
-		if user.Type == UserTypeHuman && user.Conn != nil {
-			if err := user.Conn.WriteJSON(aiMsg); err != nil {
-				log.Printf("Error writing AI response to %s: %v", user.ID, err)
+// PartnerOf 获取用户在房间中的聊天对象（对方已离开或房间已关闭时仍然返回）
+func (rm *RoomManager) PartnerOf(roomID, userID string) (string, bool) {
+	rm.mu.Lock()
+	room, ok := rm.rooms[roomID]
+	if ok && slices.Contains(room.members, userID) {
+		for _, uid := range room.members {
+			if uid != userID {
+				rm.mu.Unlock()
+				return uid, true
 			}
 		}
 	}
+	rm.mu.Unlock()
 
-	// 保存AI消息到存储
-	if storage != nil {
-		if err := storage.SaveMessage(aiMsg); err != nil {
-			log.Printf("Failed to save AI message to storage: %v", err)
+	// 房间不在本实例上时使用匹配结果
+	if assignment := matcher.GetAssignment(userID); assignment != nil && assignment.RoomID == roomID {
+		return assignment.PartnerID, true
+	}
+
+	// 房间已关闭且匹配结果已清除时使用存储中的会话记录
+	if rm.storage == nil {
+		return "", false
+	}
+	members, err := rm.storage.GetRoomMembers(roomID)
+	if err != nil {
+		log.Printf("Failed to get members of room %s: %v", roomID, err)
+		return "", false
+	}
+	if !slices.Contains(members, userID) {
+		return "", false
+	}
+	for _, uid := range members {
+		if uid != userID {
+			return uid, true
 		}
 	}
+	return "", false
 }
 
-// JoinRoom 用户加入WS
-func (rm *RoomManager) JoinRoom(roomID, userID string, conn *websocket.Conn) {
+// IsMember 用户是否为房间成员：本实例上的房间使用创建时记录的成员，其他房间查询存储中的会话记录
+func (rm *RoomManager) IsMember(roomID, userID string) (bool, error) {
 	rm.mu.Lock()
 	room, ok := rm.rooms[roomID]
 	rm.mu.Unlock()
-	if !ok {
+	if ok {
+		return slices.Contains(room.members, userID), nil
+	}
+
+	if rm.storage == nil {
+		// 没有存储时只能使用匹配结果
+		assignment := matcher.GetAssignment(userID)
+		return assignment != nil && assignment.RoomID == roomID, nil
+	}
+	members, err := rm.storage.GetRoomMembers(roomID)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(members, userID), nil
+}
+
+// rejectSession 会话无效时告知客户端重新匹配并关闭连接
+func rejectSession(conn *websocket.Conn, roomID, userID string) {
+	log.Printf("User [%s] failed to join room [%s]", userID, roomID)
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	conn.WriteJSON(Message{From: "system", Content: "会话已失效，请重新匹配", Type: MessageTypeSession, RoomID: roomID, Timestamp: time.Now()})
+	conn.Close()
+}
+
+// JoinRoom 用户加入WS，resume.Token不为空时恢复断线前的会话并补发期间的消息；
+// 会话保存在匹配队列中，断线后可以重连到任意实例。非房间成员以关闭码4403拒绝
+func (rm *RoomManager) JoinRoom(roomID, userID string, conn *websocket.Conn, resume ResumeRequest) {
+	member, err := rm.IsMember(roomID, userID)
+	if err != nil {
+		log.Printf("Failed to check membership of room [%s]: %v", roomID, err)
+		closeWithCode(conn, websocket.CloseInternalServerErr, "membership check failed")
 		return
 	}
-	user, ok := room.Users[userID]
+	if !member {
+		log.Printf("User [%s] is not a member of room [%s]", userID, roomID)
+		closeWithCode(conn, CloseNotRoomMember, "not a room member")
+		return
+	}
+
+	// 断线时间取自共享的会话，连接可能断开在其他实例上
+	var disconnectedAt time.Time
+	if resume.Token != "" {
+		session, err := matcher.queue.GetResume(userID)
+		if err != nil {
+			log.Printf("Failed to get resume session for %s: %v", userID, err)
+		}
+		if session == nil || session.RoomID != roomID || session.Token != resume.Token {
+			rejectSession(conn, roomID, userID)
+			return
+		}
+		disconnectedAt = session.DisconnectedAt
+	}
+
+	rm.mu.Lock()
+	room, ok := rm.rooms[roomID]
+	if !ok {
+		room, ok = rm.attachRoom(roomID, userID)
+	}
+	var user *User
+	if ok {
+		user, ok = room.user(userID)
+	}
+	token := GenerateResumeToken()
 	if ok {
-		user.Conn = conn
+		// 恢复会话时令牌只能使用一次，同时在多个实例上恢复时只有一个成功
+		saved, err := matcher.queue.SaveResume(userID, ResumeSession{RoomID: roomID, Token: token}, resume.Token)
+		if err != nil {
+			// 保存失败时仍允许新的连接加入，只是之后无法恢复会话
+			log.Printf("Failed to save resume session for %s: %v", userID, err)
+			saved = resume.Token == ""
+		}
+		ok = saved
+	}
+	if !ok {
+		rm.mu.Unlock()
+		rejectSession(conn, roomID, userID)
+		return
+	}
+
+	// 宽限期内重新连接时取消离开房间
+	if user.graceTimer != nil {
+		user.graceTimer.Stop()
+		user.graceTimer = nil
+	}
+	user.disconnectedAt = time.Time{}
+	user.resumeToken = token
+	// 同一用户再次连接时关闭旧连接
+	wsConn := NewWSConn(conn)
+	if old := user.conn.Swap(wsConn); old != nil {
+		old.Close()
+	}
+	session := Message{From: "system", Type: MessageTypeSession, RoomID: roomID, Timestamp: time.Now(), ResumeToken: user.resumeToken}
+	partnerLeft := len(room.users()) == 1
+	rm.mu.Unlock()
+
+	if err := user.Send(session); err != nil {
+		log.Printf("Error writing session to %s: %v", userID, err)
 	}
-	go rm.handleMessages(room, user)
+	if resume.Token != "" {
+		rm.replayMessages(room, user, resume.LastID, disconnectedAt)
+	}
+	// 断线期间或加入房间前（对方取消了匹配）对方已离开
+	if partnerLeft {
+		user.Send(Message{From: "system", Content: "对方已经离开"})
+	}
+	go rm.handleMessages(room, user, wsConn)
+
+	// 通知对方用户已上线
+	rm.publish(room, Message{From: userID, RoomID: roomID, Type: MessageTypeEvent, Event: EventOnline, Timestamp: time.Now()})
 }
 
-// handleMessages 处理用户消息
-func (rm *RoomManager) handleMessages(room *Room, user *User) {
+// replayMessages 补发对方在lastID之后发送的消息，找不到lastID时补发断线之后的消息
+func (rm *RoomManager) replayMessages(room *Room, user *User, lastID string, since time.Time) {
+	if rm.storage == nil {
+		return
+	}
+	history, err := rm.storage.GetChatHistory(room.ID, maxReplayMessages)
+	if err != nil {
+		log.Printf("Failed to get chat history for room %s: %v", room.ID, err)
+		return
+	}
+
+	start := -1
+	for i, msg := range history {
+		if lastID != "" && msg.ID == lastID {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		if since.IsZero() {
+			return
+		}
+		start = len(history)
+		for i, msg := range history {
+			if msg.Timestamp.After(since) {
+				start = i
+				break
+			}
+		}
+	}
+
+	replayed := 0
+	for _, msg := range history[start:] {
+		if msg.From == user.ID {
+			continue
+		}
+		msg.ClientID, msg.DeliveredAt, msg.ReadAt = "", nil, nil
+		msg.Replay = true
+		if err := user.Send(msg); err != nil {
+			log.Printf("Error replaying message to %s: %v", user.ID, err)
+			return
+		}
+		replayed++
+	}
+	log.Printf("Replayed %d messages to %s in room %s", replayed, user.ID, room.ID)
+}
+
+// handleMessages 处理用户消息，连接意外断开时在宽限期内保留用户位置
+func (rm *RoomManager) handleMessages(room *Room, user *User, conn *WSConn) {
+	leaving := false
 	defer func() {
-		user.Conn.Close()
-		rm.cleanupUser(room, user.ID)
+		conn.Close()
+		if leaving || rm.config.ResumeGrace <= 0 {
+			rm.leaveRoom(room, user, conn)
+		} else {
+			rm.suspendUser(room, user, conn)
+		}
 	}()
 	for {
 		var msg Message
-		err := user.Conn.ReadJSON(&msg)
+		err := conn.ReadJSON(&msg)
 		if err != nil {
+			// 客户端主动关闭连接表示离开房间
+			leaving = websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived)
 			log.Printf("Read error: %v", err)
 			break
 		}
-		log.Printf("Received message: %+v from %s\n", msg, user.ID)
-
 		// 设置消息属性
 		msg.From = user.ID
 		msg.RoomID = room.ID
-		msg.ID = GenerateMessageID()
 		msg.Timestamp = time.Now()
 
-		// 保存消息到存储
+		// 临时事件直接转发给对方，不保存
+		if msg.Type == MessageTypeEvent {
+			if !msg.Event.Valid() {
+				log.Printf("Unknown event %q from %s", msg.Event, user.ID)
+				continue
+			}
+			rm.publish(room, Message{From: msg.From, RoomID: msg.RoomID, Timestamp: msg.Timestamp, Type: MessageTypeEvent, Event: msg.Event})
+			continue
+		}
+
+		// 送达/已读回执：保存后转发给消息发送者
+		if msg.Type == MessageTypeReceipt {
+			if msg.ID == "" || (msg.Receipt != ReceiptDelivered && msg.Receipt != ReceiptRead) {
+				log.Printf("Invalid receipt %q for message %q from %s", msg.Receipt, msg.ID, user.ID)
+				continue
+			}
+			rm.saveReceipt(room, msg.ID, msg.From, msg.Receipt)
+			continue
+		}
+
+		if len(msg.ClientID) > maxClientIDLength {
+			log.Printf("Client ID too long from %s", user.ID)
+			continue
+		}
+
+		log.Printf("Received message: %+v from %s\n", msg, user.ID)
+		msg.ID = GenerateMessageID()
+
+		// 保存消息到存储，客户端重发的消息不再保存和转发
+		duplicate := false
 		if rm.storage != nil {
-			if err := rm.storage.SaveMessage(msg); err != nil {
+			saved, dup, err := rm.storage.SaveMessageDedup(msg, rm.config.DedupeWindow)
+			if err != nil {
 				log.Printf("Failed to save message to storage: %v", err)
+			} else {
+				msg, duplicate = saved, dup
 			}
 		}
 
-		room.MsgChan <- msg
+		// 告知发送者服务端的消息ID和时间戳，之后的送达/已读回执使用该ID
+		sent := Message{ID: msg.ID, ClientID: msg.ClientID, From: msg.From, RoomID: msg.RoomID, Timestamp: msg.Timestamp, Type: MessageTypeReceipt, Receipt: ReceiptSent}
+		if err := user.Send(sent); err != nil {
+			log.Printf("Error writing receipt to %s: %v", user.ID, err)
+		}
+		if duplicate {
+			log.Printf("Duplicate message %s (client id %s) from %s", msg.ID, msg.ClientID, user.ID)
+			continue
+		}
+
+		msg.ClientID = ""
+		rm.publish(room, msg)
+	}
+}
+
+// saveReceipt 保存消息回执并转发给房间中的其他用户（即消息发送者），from为回执的发出者；
+// 消息不在该房间中或由from发送时忽略回执
+func (rm *RoomManager) saveReceipt(room *Room, messageID, from string, status ReceiptStatus) {
+	now := time.Now()
+	if rm.storage != nil {
+		saved, err := rm.storage.SaveReceipt(room.ID, messageID, from, status, now)
+		if err != nil {
+			log.Printf("Failed to save receipt for message %s: %v", messageID, err)
+			return
+		}
+		if !saved {
+			log.Printf("Ignoring receipt for message %s from %s: not a partner's message in room %s", messageID, from, room.ID)
+			return
+		}
 	}
+	rm.publish(room, Message{ID: messageID, From: from, RoomID: room.ID, Timestamp: now, Type: MessageTypeReceipt, Receipt: status})
+}
+
+// leaveRoom 用户离开房间；连接已被新的连接（可能在其他实例上）替换时忽略
+func (rm *RoomManager) leaveRoom(room *Room, user *User, conn *WSConn) {
+	rm.mu.Lock()
+	replaced := user.Conn() != conn
+	token := user.resumeToken
+	if !replaced {
+		user.conn.Store(nil)
+	}
+	rm.mu.Unlock()
+	if !replaced && rm.clearResume(room, user.ID, token) {
+		rm.cleanupUser(room, user.ID)
+	}
+}
+
+// clearResume 删除用户的会话，用户已在其他实例上恢复会话时返回false
+func (rm *RoomManager) clearResume(room *Room, userID, token string) bool {
+	cleared, err := matcher.queue.ClearResume(userID, token)
+	if err != nil {
+		log.Printf("Failed to clear resume session for %s: %v", userID, err)
+		return true
+	}
+	if !cleared {
+		log.Printf("User [%s] resumed room [%s] on another connection", userID, room.ID)
+	}
+	return cleared
+}
+
+// suspendUser 连接意外断开后保留用户位置，通知对方暂时离开，宽限期内没有重新连接时离开房间
+func (rm *RoomManager) suspendUser(room *Room, user *User, conn *WSConn) {
+	rm.mu.Lock()
+	if user.Conn() != conn {
+		rm.mu.Unlock()
+		return
+	}
+	disconnectedAt := time.Now()
+	user.conn.Store(nil)
+
+	// 在共享的会话中记录断线时间和宽限期，用户可以重连到其他实例
+	token := user.resumeToken
+	session := ResumeSession{RoomID: room.ID, Token: token, DisconnectedAt: disconnectedAt, Deadline: disconnectedAt.Add(rm.config.ResumeGrace)}
+	saved, err := matcher.queue.SaveResume(user.ID, session, token)
+	if err != nil {
+		log.Printf("Failed to save resume session for %s: %v", user.ID, err)
+	} else if !saved {
+		// 已在其他实例上恢复会话，本实例上的用户视为连接在其他实例上
+		rm.mu.Unlock()
+		log.Printf("User [%s] resumed room [%s] on another connection", user.ID, room.ID)
+		return
+	}
+
+	user.disconnectedAt = disconnectedAt
+	user.graceTimer = time.AfterFunc(rm.config.ResumeGrace, func() {
+		rm.mu.Lock()
+		expired := user.Conn() == nil && user.disconnectedAt.Equal(disconnectedAt)
+		if expired {
+			user.graceTimer = nil
+		}
+		rm.mu.Unlock()
+		if expired && rm.clearResume(room, user.ID, token) {
+			log.Printf("User [%s] did not reconnect to room [%s]", user.ID, room.ID)
+			rm.cleanupUser(room, user.ID)
+		}
+	})
+	rm.mu.Unlock()
+
+	log.Printf("User [%s] disconnected from room [%s], waiting %s for reconnect", user.ID, room.ID, rm.config.ResumeGrace)
+	rm.publish(room, Message{From: user.ID, RoomID: room.ID, Type: MessageTypeEvent, Event: EventAway, Timestamp: disconnectedAt})
 }
 
 // cleanupUser 清理断开用户
 func (rm *RoomManager) cleanupUser(room *Room, userID string) {
+	rm.removeUser(room, userID)
+
+	// 清理用户状态（只对人类用户）
+	if !IsAIUser(userID) {
+		matcher.ResetUser(userID)
+	}
+
+	// 通知其他实例上的对方（AI房间只存在于本实例）
+	if !room.withAI {
+		if err := rm.transport.Publish(RoomEvent{RoomID: room.ID, Left: userID}); err != nil {
+			log.Printf("Failed to publish leave event to room %s: %v", room.ID, err)
+		}
+	}
+}
+
+// AbandonRoom 用户加入房间前放弃匹配（票据已取消）：移出房间，通知对方并清理用户状态
+func (rm *RoomManager) AbandonRoom(roomID, userID string) {
+	rm.mu.Lock()
+	room, ok := rm.rooms[roomID]
+	rm.mu.Unlock()
+	if ok {
+		rm.cleanupUser(room, userID)
+		return
+	}
+
+	// 房间在其他实例上
+	matcher.ResetUser(userID)
+	if err := rm.transport.Publish(RoomEvent{RoomID: roomID, Left: userID}); err != nil {
+		log.Printf("Failed to publish leave event to room %s: %v", roomID, err)
+	}
+}
+
+// removeUser 将用户移出房间，通知本实例上的其他用户，必要时关闭房间
+func (rm *RoomManager) removeUser(room *Room, userID string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if _, ok := room.user(userID); !ok {
+		return
+	}
+
 	// 通知另一方（可选：发送"partner left"消息）
-	for _, u := range room.Users {
-		if u.ID != userID && u.Conn != nil {
+	for _, u := range room.users() {
+		if u.ID != userID && u.Conn() != nil {
 			if IsAIUser(userID) {
-				u.Conn.WriteJSON(Message{From: "system", Content: "AI助手已离开"})
+				u.Send(Message{From: "system", Content: "AI助手已离开"})
 			} else {
-				u.Conn.WriteJSON(Message{From: "system", Content: "对方已经离开"})
+				u.Send(Message{From: "system", Content: "对方已经离开"})
 			}
 		}
 	}
 
 	// 移除房间如果空或者只剩AI用户
-	rm.mu.Lock()
-	delete(room.Users, userID)
+	remaining := room.deleteUser(userID)
 
 	// 检查是否需要关闭房间
 	shouldCloseRoom := false
-	if len(room.Users) == 0 {
+	if len(remaining) == 0 {
 		shouldCloseRoom = true
-	} else if len(room.Users) == 1 {
+	} else if len(remaining) == 1 {
 		// 如果只剩下AI用户，也关闭房间
-		for _, user := range room.Users {
+		for _, user := range remaining {
 			if user.Type == UserTypeAI {
 				shouldCloseRoom = true
 				break
@@ -256,23 +760,17 @@ func (rm *RoomManager) cleanupUser(room *Room, userID string) {
 			}
 		}
 
-		if _, ok := rm.rooms[room.ID]; ok {
-			close(room.MsgChan)
+		room.close()
+		if rm.rooms[room.ID] == room {
+			delete(rm.rooms, room.ID)
 		}
-		delete(rm.rooms, room.ID)
 	}
-
-	// 清理用户状态（只对人类用户）
-	if !IsAIUser(userID) {
-		delete(matcher.userStates, userID)
-	}
-	rm.mu.Unlock()
 }
 
 // sendAIGreeting AI主动发起打招呼
 func (rm *RoomManager) sendAIGreeting(room *Room, aiUserID string) {
 	// 等待一个短暂时间，让房间和连接充分初始化
-	time.Sleep(500 * time.Millisecond)
+	time.Sleep(rm.config.AIGreetingDelay)
 
 	// 检查房间是否仍然存在
 	rm.mu.Lock()
@@ -282,12 +780,18 @@ func (rm *RoomManager) sendAIGreeting(room *Room, aiUserID string) {
 		return
 	}
 
-	// 生成AI打招呼消息
+	// 生成AI打招呼消息，人设配置了固定打招呼消息时直接使用
 	var greetingContent string
-	if aiClient := matcher.GetAIClient(); aiClient != nil {
-		ctx := context.Background()
-
-		aiResponse, err := aiClient.ChatResponse(ctx, RolePrompt)
+	if room.persona.Greeting != "" {
+		greetingContent = room.persona.Greeting
+	} else if aiClient := matcher.GetAIClient(); aiClient != nil {
+		timeout := rm.config.AIReplyTimeout
+		if timeout <= 0 {
+			timeout = defaultAIReplyTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		aiResponse, err := aiClient.Greeting(ctx, room.persona)
+		cancel()
 		if err != nil {
 			log.Printf("AI greeting generation failed: %v", err)
 			greetingContent = "👋 你好！很高兴能和你聊天，有什么想聊的吗？"
@@ -317,9 +821,9 @@ func (rm *RoomManager) sendAIGreeting(room *Room, aiUserID string) {
 	}
 
 	// 发送AI打招呼给人类用户
-	for _, user := range room.Users {
-		if user.Type == UserTypeHuman && user.Conn != nil {
-			if err := user.Conn.WriteJSON(greetingMsg); err != nil {
+	for _, user := range room.users() {
+		if user.Type == UserTypeHuman && user.Conn() != nil {
+			if err := user.Send(greetingMsg); err != nil {
 				log.Printf("Error writing AI greeting to %s: %v", user.ID, err)
 			}
 		}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"sync"
+)
+
+// RoomEvent 房间事件，由传输层转发给所有持有该房间的实例
+type RoomEvent struct {
+	RoomID  string   `json:"room_id"`
+	Message *Message `json:"message,omitempty"` // 聊天消息
+	Left    string   `json:"left,omitempty"`    // 离开房间的用户ID
+}
+
+// RoomTransport 房间消息传输层
+type RoomTransport interface {
+	// Publish 发布房间事件
+	Publish(event RoomEvent) error
+	// Subscribe 订阅房间事件，返回取消订阅函数
+	Subscribe(roomID string, handler func(RoomEvent)) (func(), error)
+}
+
+// LocalRoomTransport 进程内传输层（单实例部署），发布时直接调用本实例的订阅者
+type LocalRoomTransport struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[string]map[int]func(RoomEvent) // roomID -> 订阅者
+}
+
+// NewLocalRoomTransport 创建进程内传输层
+func NewLocalRoomTransport() RoomTransport {
+	return &LocalRoomTransport{
+		handlers: make(map[string]map[int]func(RoomEvent)),
+	}
+}
+
+// Publish 发布房间事件
+func (t *LocalRoomTransport) Publish(event RoomEvent) error {
+	t.mu.RLock()
+	handlers := make([]func(RoomEvent), 0, len(t.handlers[event.RoomID]))
+	for _, handler := range t.handlers[event.RoomID] {
+		handlers = append(handlers, handler)
+	}
+	t.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+// Subscribe 订阅房间事件
+func (t *LocalRoomTransport) Subscribe(roomID string, handler func(RoomEvent)) (func(), error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	id := t.nextID
+	if _, ok := t.handlers[roomID]; !ok {
+		t.handlers[roomID] = make(map[int]func(RoomEvent))
+	}
+	t.handlers[roomID][id] = handler
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.handlers[roomID], id)
+		if len(t.handlers[roomID]) == 0 {
+			delete(t.handlers, roomID)
+		}
+	}, nil
+}
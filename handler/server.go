@@ -1,111 +1,247 @@
 package handler
 
 import (
-	"context"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/toujourser/chat-matcher/middlewares"
 )
 
+// 消息存档单次查询返回的最大消息数
+const maxArchiveMessages = 1000
+
 var (
-	matcher     *Matcher
-	roomManager *RoomManager
-	storage     Storage
-	upgrader    = websocket.Upgrader{
+	matcher       *Matcher
+	roomManager   *RoomManager
+	storage       Storage
+	authenticator *Authenticator
+	upgrader      = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true }, // 允许跨域
 	}
 )
 
 // InitializeHandlers 初始化处理器
-func InitializeHandlers(storageImpl Storage) {
+func InitializeHandlers(storageImpl Storage, queue MatchQueue, transport RoomTransport, auth *Authenticator, matcherConfig MatcherConfig, roomConfig RoomConfig) {
 	storage = storageImpl
-	matcher = NewMatcher(storage)
-	roomManager = NewRoomManager(storage)
+	authenticator = auth
+	matcher = NewMatcher(storage, queue, matcherConfig)
+	roomManager = NewRoomManager(storage, transport, roomConfig)
 }
 
-// MatchHandle 处理匹配请求 (Gin版本)
+// MatchHandle 创建匹配票据并立即返回，后台继续匹配 (Gin版本)
 func MatchHandle(c *gin.Context) {
 	var req MatchRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	req.UserID = middlewares.UserID(c)
+
+	now := time.Now()
+	ticket, created, err := matcher.queue.CreateTicket(MatchTicket{
+		ID:        GenerateTicketID(),
+		UserID:    req.UserID,
+		Status:    TicketQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	if err != nil {
+		log.Printf("Failed to create match ticket: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create match ticket"})
+		return
+	}
+	// 已有进行中的票据时直接返回，避免重复匹配
+	if !created {
+		c.JSON(http.StatusAccepted, ticket)
+		return
+	}
+
+	log.Printf("用户 %s 开始匹配，票据 ID：%s", req.UserID, ticket.ID)
+	go runMatchTicket(*ticket, req)
+
+	c.JSON(http.StatusAccepted, ticket)
+}
+
+// MatchTicketHandle 查询匹配票据状态 (Gin版本)
+func MatchTicketHandle(c *gin.Context) {
+	ticket, ok := userTicket(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, ticket)
+}
+
+// userTicket 读取当前用户的匹配票据，出错或票据不属于当前用户时写入错误响应
+func userTicket(c *gin.Context) (*MatchTicket, bool) {
+	ticket, err := matcher.queue.GetTicket(c.Param("ticket"))
+	if err != nil {
+		log.Printf("Failed to get match ticket: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get match ticket"})
+		return nil, false
+	}
+	if ticket == nil || ticket.UserID != middlewares.UserID(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+		return nil, false
+	}
+	return ticket, true
+}
 
-	ctx, cancel := context.WithTimeout(c, 10*time.Second)
-	defer cancel()
+// MatchEventsHandle 通过SSE推送匹配票据状态，票据结束（匹配成功、失败或取消）后关闭连接 (Gin版本)
+func MatchEventsHandle(c *gin.Context) {
+	ticketID := c.Param("ticket")
+	ticket, ok := userTicket(c)
+	if !ok {
+		return
+	}
 
-	interval := 1 * time.Second
-	ticker := time.NewTicker(interval)
+	// 票据可能在其他实例上更新，定期从匹配队列读取
+	ticker := time.NewTicker(ticketPushInterval)
 	defer ticker.Stop()
 
-	var resp MatchResponse
-	for {
-		resp = match(req)
-		select {
-		case <-ctx.Done():
-			// 超时后尝试与AI匹配
-			if !resp.Matched {
-				log.Printf("用户 %s 匹配超时，尝试与AI匹配", req.UserID)
-				roomID, aiUserID, matched := matcher.MatchWithAI(req.UserID)
-				if matched {
-					resp = MatchResponse{Matched: true, RoomID: roomID, Partner: aiUserID}
-					// 创建AI房间
-					roomManager.CreateAIRoom(roomID, req.UserID, aiUserID)
-					log.Printf("用户 %s 成功与AI %s 匹配，房间 ID：%s", req.UserID, aiUserID, roomID)
-				} else {
-					log.Printf("用户 %s AI匹配失败", req.UserID)
-				}
+	var lastStatus TicketStatus
+	c.Stream(func(w io.Writer) bool {
+		if ticket.Status != lastStatus {
+			lastStatus = ticket.Status
+			c.SSEvent("ticket", ticket)
+			if ticket.Status != TicketQueued {
+				return false
 			}
-			c.JSON(http.StatusOK, resp)
-			return
+		}
 
+		select {
+		case <-c.Request.Context().Done():
+			return false
 		case <-ticker.C:
-			if resp.Matched {
-				log.Printf("用户 ID：%s, 匹配结果：%v, 房间 ID：%s, 对方 ID：%s", req.UserID, resp.Matched, resp.RoomID, resp.Partner)
-				c.JSON(http.StatusOK, resp)
-				return
-			}
 		}
+
+		current, err := matcher.queue.GetTicket(ticketID)
+		if err != nil {
+			log.Printf("Failed to get match ticket: %v", err)
+			return true
+		}
+		if current == nil {
+			// 票据已过期或被同一用户的新票据替换
+			return false
+		}
+		ticket = current
+		return true
+	})
+}
+
+// LobbyEventsHandle 通过SSE推送用户的匹配生命周期事件（排队、排队位置、匹配成功、AI匹配、取消） (Gin版本)
+func LobbyEventsHandle(c *gin.Context) {
+	userID := middlewares.UserID(c)
+
+	// 空闲用户可能长时间没有事件，先写出响应头
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// 用户状态可能在其他实例上更新，定期从匹配队列读取
+	ticker := time.NewTicker(lobbyPushInterval)
+	defer ticker.Stop()
+
+	var prev matchSnapshot
+	c.Stream(func(w io.Writer) bool {
+		cur := matcher.snapshot(userID)
+		for _, event := range matchEvents(userID, prev, cur) {
+			c.SSEvent(string(event.Type), event)
+		}
+		prev = cur
+
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-ticker.C:
+			return true
+		}
+	})
+}
+
+// CancelMatchHandle 取消匹配票据 (Gin版本)
+func CancelMatchHandle(c *gin.Context) {
+	ticket, ok := userTicket(c)
+	if !ok {
+		return
+	}
+	if ticket.Status != TicketQueued {
+		c.JSON(http.StatusConflict, ticket)
+		return
+	}
+
+	// 与后台匹配竞争，只有票据仍在等待时才能取消
+	ticket.Status = TicketCancelled
+	if !updateTicket(ticket) {
+		if current, err := matcher.queue.GetTicket(ticket.ID); err == nil && current != nil {
+			ticket = current
+		}
+		c.JSON(http.StatusConflict, ticket)
+		return
 	}
+	// 已被其他用户领取时由匹配协程离开房间
+	matcher.CancelMatch(ticket.UserID)
+
+	c.JSON(http.StatusOK, ticket)
 }
 
 func match(req MatchRequest) MatchResponse {
-	resp := MatchResponse{Matched: false}
 	// 如果用户已经在聊天状态，则直接返回匹配结果
-	userState := matcher.CheckUserState(req.UserID)
-	if userState != nil && *userState == StateChatting {
-		for _, room := range roomManager.rooms {
-			for userId, user := range room.Users {
-				if userId == req.UserID {
-					resp.Matched = true
-					resp.RoomID = room.ID
-					resp.Partner = strings.Split(room.ID, "-")[0]
-				} else {
-					resp.Partner = user.ID
-				}
-			}
-		}
-	} else {
-		roomID, partnerID, matched := matcher.RequestMatch(req.UserID)
-		resp = MatchResponse{Matched: matched, RoomID: roomID, Partner: partnerID}
-		if matched {
-			roomManager.CreateRoom(roomID, req.UserID, partnerID)
-		}
+	if resp, ok := currentMatch(req.UserID); ok {
+		return resp
 	}
-	return resp
+	if assignment, matched := matcher.RequestMatch(req); matched {
+		roomManager.CreateRoom(assignment.RoomID, req.UserID, assignment.PartnerID)
+		return MatchResponse{Matched: true, RoomID: assignment.RoomID, Partner: assignment.PartnerID, CommonTags: assignment.CommonTags}
+	}
+	return MatchResponse{Matched: false}
+}
+
+// currentMatch 用户已在聊天状态时返回匹配结果，匹配结果由发起匹配的一方记录，可能来自其他实例
+func currentMatch(userID string) (MatchResponse, bool) {
+	userState := matcher.CheckUserState(userID)
+	if userState == nil || *userState != StateChatting {
+		return MatchResponse{}, false
+	}
+	assignment := matcher.GetAssignment(userID)
+	if assignment == nil {
+		return MatchResponse{}, false
+	}
+	return MatchResponse{
+		Matched:    true,
+		RoomID:     assignment.RoomID,
+		Partner:    assignment.PartnerID,
+		CommonTags: assignment.CommonTags,
+		Persona:    assignment.Persona,
+	}, true
+}
+
+// PersonasHandle 获取可选的AI人设列表 (Gin版本)
+func PersonasHandle(c *gin.Context) {
+	personas := roomManager.personas.List()
+	infos := make([]*PersonaInfo, 0, len(personas))
+	for _, persona := range personas {
+		infos = append(infos, persona.Info())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"personas": infos,
+		"count":    len(infos),
+	})
 }
 
 // WSHandle 处理WebSocket连接 (Gin版本)
 func WSHandle(c *gin.Context) {
 	roomID := c.Query("room")
-	userID := c.Query("user")
-	if roomID == "" || userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing room or user"})
+	userID := middlewares.UserID(c)
+	if roomID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing room"})
 		return
 	}
 
@@ -116,7 +252,48 @@ func WSHandle(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade connection"})
 		return
 	}
-	roomManager.JoinRoom(roomID, userID, conn)
+	roomManager.JoinRoom(roomID, userID, conn, ResumeRequest{Token: c.Query("resume"), LastID: c.Query("last_id")})
+}
+
+// BlockPartnerHandle 屏蔽房间中的聊天对象，之后双方不会再被匹配 (Gin版本)
+func BlockPartnerHandle(c *gin.Context) {
+	var req BlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserID = middlewares.UserID(c)
+	if req.RoomID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing room_id"})
+		return
+	}
+
+	if storage == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage not available"})
+		return
+	}
+
+	partnerID, ok := roomManager.PartnerOf(req.RoomID, req.UserID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Partner not found in room"})
+		return
+	}
+	if IsAIUser(partnerID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot block AI partner"})
+		return
+	}
+
+	if err := storage.BlockUser(req.UserID, partnerID); err != nil {
+		log.Printf("Failed to block user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+
+	log.Printf("用户 %s 屏蔽了 %s，房间 ID：%s", req.UserID, partnerID, req.RoomID)
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":    req.UserID,
+		"blocked_id": partnerID,
+	})
 }
 
 // ChatHistoryHandle 获取聊天历史 (Gin版本)
@@ -138,6 +315,20 @@ func ChatHistoryHandle(c *gin.Context) {
 		return
 	}
 
+	// 只能查看自己参与过的房间，管理员可以查看任意房间
+	if !middlewares.IsAdmin(c) {
+		member, err := roomManager.IsMember(roomID, middlewares.UserID(c))
+		if err != nil {
+			log.Printf("Failed to check room membership: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get chat history"})
+			return
+		}
+		if !member {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+			return
+		}
+	}
+
 	messages, err := storage.GetChatHistory(roomID, limit)
 	if err != nil {
 		log.Printf("Failed to get chat history: %v", err)
@@ -152,11 +343,86 @@ func ChatHistoryHandle(c *gin.Context) {
 	})
 }
 
-// UserStatsHandle 获取用户匹配统计 (Gin版本)
-func UserStatsHandle(c *gin.Context) {
+// MessageArchiveHandle 按房间、发送者和时间范围查询消息存档，需要SQLite存储 (Gin版本)
+func MessageArchiveHandle(c *gin.Context) {
+	querier, ok := storage.(MessageQuerier)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Message archive requires SQLite storage"})
+		return
+	}
+
+	query := MessageQuery{
+		RoomID: c.Query("room_id"),
+		UserID: c.Query("user_id"),
+	}
+	for name, field := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s parameter, expected RFC3339", name)})
+			return
+		}
+		*field = t
+	}
+	if limit, err := strconv.Atoi(c.DefaultQuery("limit", "100")); err == nil && limit > 0 {
+		query.Limit = min(limit, maxArchiveMessages)
+	}
+
+	// 只能查询自己参与过的房间，不指定房间时只能查询自己发送的消息；管理员不受限制
+	if !middlewares.IsAdmin(c) {
+		if query.RoomID == "" {
+			userID, ok := targetUser(c)
+			if !ok {
+				return
+			}
+			query.UserID = userID
+		} else {
+			member, err := roomManager.IsMember(query.RoomID, middlewares.UserID(c))
+			if err != nil {
+				log.Printf("Failed to check room membership: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query messages"})
+				return
+			}
+			if !member {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+				return
+			}
+		}
+	}
+
+	messages, err := querier.QueryMessages(query)
+	if err != nil {
+		log.Printf("Failed to query messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages": messages,
+		"count":    len(messages),
+	})
+}
+
+// targetUser 读取要查询的用户：user_id参数为空时为当前用户，查询其他用户需要管理员角色，否则写入403响应
+func targetUser(c *gin.Context) (string, bool) {
 	userID := c.Query("user_id")
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing user_id parameter"})
+	if userID == "" || userID == middlewares.UserID(c) {
+		return middlewares.UserID(c), true
+	}
+	if !middlewares.IsAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot access other users' data"})
+		return "", false
+	}
+	return userID, true
+}
+
+// UserStatsHandle 获取用户的匹配统计，默认为当前用户 (Gin版本)
+func UserStatsHandle(c *gin.Context) {
+	userID, ok := targetUser(c)
+	if !ok {
 		return
 	}
 
@@ -175,11 +441,10 @@ func UserStatsHandle(c *gin.Context) {
 	c.JSON(http.StatusOK, stats)
 }
 
-// UserRoomsHandle 获取用户参与的房间列表 (Gin版本)
+// UserRoomsHandle 获取用户参与的房间列表，默认为当前用户 (Gin版本)
 func UserRoomsHandle(c *gin.Context) {
-	userID := c.Query("user_id")
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing user_id parameter"})
+	userID, ok := targetUser(c)
+	if !ok {
 		return
 	}
 
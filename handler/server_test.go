@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toujourser/chat-matcher/middlewares"
+)
+
+// newAccessTestServer 使用内存存储和真实的令牌签发器注册需要令牌的查询接口，
+// 房间 r_test 的成员为 alice 和 bob
+func newAccessTestServer(t *testing.T) (*gin.Engine, *Authenticator) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	auth := NewAuthenticator(strings.Repeat("s", 32), "", time.Hour)
+	InitializeHandlers(NewMemoryStorage(0), NewMemoryMatchQueue(), NewLocalRoomTransport(), auth,
+		MatcherConfig{AI: AIConfig{Provider: ProviderScripted}}, RoomConfig{})
+	if err := storage.CreateChatSession("r_test", []string{"alice", "bob"}); err != nil {
+		t.Fatalf("CreateChatSession: %v", err)
+	}
+	if err := storage.SaveMessage(Message{ID: "m1", From: "alice", RoomID: "r_test", Content: "hi", Type: "text"}); err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+
+	r := gin.New()
+	authed := r.Group("/api", middlewares.Auth(auth.Verify))
+	authed.GET("/chat/history", ChatHistoryHandle)
+	authed.GET("/user/stats", UserStatsHandle)
+	authed.GET("/user/rooms", UserRoomsHandle)
+	return r, auth
+}
+
+func TestAccessControl(t *testing.T) {
+	r, auth := newAccessTestServer(t)
+	token := func(userID, role string) string {
+		tok, _ := auth.Issue(userID, role)
+		return tok
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{"history participant", "/api/chat/history?room_id=r_test", token("alice", ""), http.StatusOK},
+		{"history other participant", "/api/chat/history?room_id=r_test", token("bob", ""), http.StatusOK},
+		{"history non-participant", "/api/chat/history?room_id=r_test", token("carol", ""), http.StatusForbidden},
+		{"history admin", "/api/chat/history?room_id=r_test", token("admin", middlewares.RoleAdmin), http.StatusOK},
+		{"history missing token", "/api/chat/history?room_id=r_test", "", http.StatusUnauthorized},
+		{"history invalid token", "/api/chat/history?room_id=r_test", "garbage", http.StatusUnauthorized},
+		{"history forged signature", "/api/chat/history?room_id=r_test", token("alice", "") + "x", http.StatusUnauthorized},
+
+		{"stats self", "/api/user/stats", token("carol", ""), http.StatusOK},
+		{"stats self by id", "/api/user/stats?user_id=carol", token("carol", ""), http.StatusOK},
+		{"stats other non-admin", "/api/user/stats?user_id=alice", token("carol", ""), http.StatusForbidden},
+		{"stats other admin", "/api/user/stats?user_id=alice", token("admin", middlewares.RoleAdmin), http.StatusOK},
+		{"stats missing token", "/api/user/stats", "", http.StatusUnauthorized},
+
+		{"rooms self", "/api/user/rooms", token("alice", ""), http.StatusOK},
+		{"rooms other non-admin", "/api/user/rooms?user_id=alice", token("carol", ""), http.StatusForbidden},
+		{"rooms other admin", "/api/user/rooms?user_id=alice", token("admin", middlewares.RoleAdmin), http.StatusOK},
+		{"rooms invalid token", "/api/user/rooms", "garbage", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("GET %s: status = %d, want %d (body %s)", tt.path, w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTokenQueryParameter(t *testing.T) {
+	r, auth := newAccessTestServer(t)
+	tok, _ := auth.Issue("bob", "")
+
+	// WebSocket和SSE无法设置请求头，令牌通过token参数传递
+	req := httptest.NewRequest(http.MethodGet, "/api/chat/history?room_id=r_test&token="+tok, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusOK, w.Body.String())
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	r, _ := newAccessTestServer(t)
+	// 使用相同密钥签发已过期的令牌
+	expired := &Authenticator{secret: []byte(strings.Repeat("s", 32)), ttl: -time.Minute}
+	tok, _ := expired.Issue("alice", "")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/chat/history?room_id=r_test", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
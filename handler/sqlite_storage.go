@@ -0,0 +1,559 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // 纯Go实现的SQLite驱动，无需CGO
+)
+
+const (
+	sqliteDriver     = "sqlite"
+	defaultSQLiteDSN = "data/chat-matcher.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+)
+
+// sqliteMigrations 数据库结构迁移，按顺序执行，已执行的版本记录在schema_migrations表中
+// 注意：只能追加新的迁移，不要修改已发布的迁移语句
+var sqliteMigrations = []string{
+	// 1: 消息、会话与匹配统计
+	`CREATE TABLE IF NOT EXISTS messages (
+		seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+		id         TEXT    NOT NULL,
+		room_id    TEXT    NOT NULL,
+		from_user  TEXT    NOT NULL,
+		content    TEXT    NOT NULL,
+		type       TEXT    NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_messages_room_time ON messages (room_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_messages_user_time ON messages (from_user, created_at);
+	CREATE INDEX IF NOT EXISTS idx_messages_time ON messages (created_at);
+
+	CREATE TABLE IF NOT EXISTS chat_sessions (
+		room_id  TEXT    PRIMARY KEY,
+		start_at INTEGER NOT NULL,
+		end_at   INTEGER,
+		active   INTEGER NOT NULL DEFAULT 1
+	);
+	CREATE TABLE IF NOT EXISTS session_users (
+		room_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		PRIMARY KEY (room_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_session_users_user ON session_users (user_id);
+
+	CREATE TABLE IF NOT EXISTS match_stats (
+		user_id       TEXT    PRIMARY KEY,
+		match_count   INTEGER NOT NULL DEFAULT 0,
+		last_match_at TEXT    NOT NULL DEFAULT ''
+	);`,
+	// 2: 用户屏蔽列表
+	`CREATE TABLE IF NOT EXISTS user_blocks (
+		user_id    TEXT    NOT NULL,
+		blocked_id TEXT    NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, blocked_id)
+	);`,
+	// 3: AI对话摘要
+	`CREATE TABLE IF NOT EXISTS room_summaries (
+		room_id    TEXT    PRIMARY KEY,
+		summary    TEXT    NOT NULL,
+		up_to      INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);`,
+	// 4: 消息回执
+	`ALTER TABLE messages ADD COLUMN delivered_at INTEGER;
+	ALTER TABLE messages ADD COLUMN read_at INTEGER;
+	CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages (room_id, id);`,
+	// 5: 客户端消息ID，用于重发去重
+	`ALTER TABLE messages ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_messages_room_client ON messages (room_id, client_id, created_at);`,
+	// 6: 按被屏蔽用户查询屏蔽列表
+	`CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks (blocked_id);`,
+}
+
+// MessageQuery 消息查询条件，零值字段表示不限制
+type MessageQuery struct {
+	RoomID string
+	UserID string    // 发送者ID
+	Since  time.Time // 起始时间（包含）
+	Until  time.Time // 结束时间（不包含）
+	Limit  int
+}
+
+// SQLiteStorage SQLite存储实现，数据永久保存
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// NewSQLiteStorage 创建SQLite存储实例并执行数据库迁移，dsn为空时使用 data/chat-matcher.db
+func NewSQLiteStorage(dsn string) (*SQLiteStorage, error) {
+	if dsn == "" {
+		dsn = defaultSQLiteDSN
+	}
+
+	// 数据库文件所在目录需要提前创建
+	path := strings.TrimPrefix(strings.SplitN(dsn, "?", 2)[0], "file:")
+	if path != "" && path != ":memory:" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %w", err)
+		}
+	}
+
+	db, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// SQLite只支持单个写连接，避免并发写入时出现database is locked
+	db.SetMaxOpenConns(1)
+
+	ss := &SQLiteStorage{db: db}
+	if err := ss.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// migrate 执行未执行过的数据库迁移
+func (ss *SQLiteStorage) migrate() error {
+	_, err := ss.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := ss.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(sqliteMigrations); i++ {
+		version := i + 1
+		tx, err := ss.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// Close 关闭数据库连接
+func (ss *SQLiteStorage) Close() error {
+	return ss.db.Close()
+}
+
+// SaveMessage 保存消息到数据库
+func (ss *SQLiteStorage) SaveMessage(message Message) error {
+	// 设置消息时间戳
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	return insertMessage(ss.db, message)
+}
+
+// SaveMessageDedup 在事务中查找window内相同ClientID的消息，不存在时保存
+func (ss *SQLiteStorage) SaveMessageDedup(message Message, window time.Duration) (Message, bool, error) {
+	if message.ClientID == "" {
+		return message, false, ss.SaveMessage(message)
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return message, false, fmt.Errorf("failed to save message: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT id, room_id, from_user, content, type, created_at, delivered_at, read_at, client_id FROM messages
+		WHERE room_id = ? AND client_id = ? AND created_at > ? ORDER BY created_at DESC LIMIT 1`,
+		message.RoomID, message.ClientID, message.Timestamp.Add(-window).UnixNano(),
+	)
+	if err != nil {
+		return message, false, fmt.Errorf("failed to dedupe message: %w", err)
+	}
+	saved, err := scanMessages(rows)
+	if err != nil {
+		return message, false, fmt.Errorf("failed to dedupe message: %w", err)
+	}
+	if len(saved) > 0 {
+		return saved[0], true, nil
+	}
+
+	if err := insertMessage(tx, message); err != nil {
+		return message, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return message, false, fmt.Errorf("failed to save message: %w", err)
+	}
+	return message, false, nil
+}
+
+// insertMessage 插入一条消息，db可以是*sql.DB或*sql.Tx
+func insertMessage(db interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}, message Message) error {
+	_, err := db.Exec(
+		`INSERT INTO messages (id, room_id, from_user, content, type, created_at, client_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		message.ID, message.RoomID, message.From, message.Content, message.Type, message.Timestamp.UnixNano(), message.ClientID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save message: %w", err)
+	}
+	return nil
+}
+
+// GetChatHistory 获取聊天历史
+func (ss *SQLiteStorage) GetChatHistory(roomID string, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = 100 // 默认限制100条
+	}
+
+	rows, err := ss.db.Query(
+		`SELECT id, room_id, from_user, content, type, created_at, delivered_at, read_at, client_id FROM messages
+		WHERE room_id = ? ORDER BY created_at DESC, seq DESC LIMIT ?`,
+		roomID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat history: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat history: %w", err)
+	}
+
+	// 反转以获得正确的时间顺序
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// QueryMessages 按房间、发送者和时间范围查询消息，结果按时间正序排列
+func (ss *SQLiteStorage) QueryMessages(query MessageQuery) ([]Message, error) {
+	if query.Limit <= 0 {
+		query.Limit = 100
+	}
+
+	var conditions []string
+	var args []interface{}
+	if query.RoomID != "" {
+		conditions = append(conditions, "room_id = ?")
+		args = append(args, query.RoomID)
+	}
+	if query.UserID != "" {
+		conditions = append(conditions, "from_user = ?")
+		args = append(args, query.UserID)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, query.Until.UnixNano())
+	}
+
+	stmt := `SELECT id, room_id, from_user, content, type, created_at, delivered_at, read_at, client_id FROM messages`
+	if len(conditions) > 0 {
+		stmt += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	stmt += " ORDER BY created_at, seq LIMIT ?"
+	args = append(args, query.Limit)
+
+	rows, err := ss.db.Query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	return messages, nil
+}
+
+// SaveReceipt 保存消息回执，已记录的时间不会被覆盖
+func (ss *SQLiteStorage) SaveReceipt(roomID, messageID, reader string, status ReceiptStatus, at time.Time) (bool, error) {
+	var stmt string
+	switch status {
+	case ReceiptDelivered:
+		stmt = `UPDATE messages SET delivered_at = COALESCE(delivered_at, ?1) WHERE room_id = ?2 AND id = ?3 AND from_user <> ?4`
+	case ReceiptRead:
+		stmt = `UPDATE messages SET delivered_at = COALESCE(delivered_at, ?1), read_at = COALESCE(read_at, ?1) WHERE room_id = ?2 AND id = ?3 AND from_user <> ?4`
+	default:
+		return false, nil
+	}
+	result, err := ss.db.Exec(stmt, at.UnixNano(), roomID, messageID, reader)
+	if err != nil {
+		return false, fmt.Errorf("failed to save message receipt: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to save message receipt: %w", err)
+	}
+	return updated > 0, nil
+}
+
+// nullTime 将可为空的UnixNano时间转换为时间指针
+func nullTime(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(0, v.Int64)
+	return &t
+}
+
+// scanMessages 读取消息查询结果并关闭rows
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+
+	messages := make([]Message, 0)
+	for rows.Next() {
+		var msg Message
+		var createdAt int64
+		var deliveredAt, readAt sql.NullInt64
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.From, &msg.Content, &msg.Type, &createdAt, &deliveredAt, &readAt, &msg.ClientID); err != nil {
+			return nil, err
+		}
+		msg.Timestamp = time.Unix(0, createdAt)
+		msg.DeliveredAt = nullTime(deliveredAt)
+		msg.ReadAt = nullTime(readAt)
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// GetUserChatRooms 获取用户参与的聊天室列表
+func (ss *SQLiteStorage) GetUserChatRooms(userID string) ([]string, error) {
+	rows, err := ss.db.Query(
+		`SELECT room_id FROM session_users WHERE user_id = ?
+		UNION
+		SELECT DISTINCT room_id FROM messages WHERE from_user = ?`,
+		userID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user rooms: %w", err)
+	}
+	defer rows.Close()
+
+	rooms := make([]string, 0)
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			return nil, fmt.Errorf("failed to get user rooms: %w", err)
+		}
+		rooms = append(rooms, roomID)
+	}
+	return rooms, rows.Err()
+}
+
+// IncrementMatchCount 增加用户匹配次数
+func (ss *SQLiteStorage) IncrementMatchCount(userID string) error {
+	now := time.Now().Format(time.RFC3339)
+	_, err := ss.db.Exec(
+		`INSERT INTO match_stats (user_id, match_count, last_match_at) VALUES (?, 1, ?)
+		ON CONFLICT(user_id) DO UPDATE SET match_count = match_count + 1, last_match_at = excluded.last_match_at`,
+		userID, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to increment match count: %w", err)
+	}
+	return nil
+}
+
+// GetMatchStats 获取用户匹配统计
+func (ss *SQLiteStorage) GetMatchStats(userID string) (*UserMatchStats, error) {
+	stats := &UserMatchStats{UserID: userID}
+	err := ss.db.QueryRow(
+		`SELECT match_count, last_match_at FROM match_stats WHERE user_id = ?`, userID,
+	).Scan(&stats.MatchCount, &stats.LastMatchAt)
+	if err == sql.ErrNoRows {
+		// 返回默认统计信息
+		return stats, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get match stats: %w", err)
+	}
+	return stats, nil
+}
+
+// GetAllUserStats 获取所有用户统计（用于管理和调试）
+func (ss *SQLiteStorage) GetAllUserStats() ([]UserMatchStats, error) {
+	rows, err := ss.db.Query(`SELECT user_id, match_count, last_match_at FROM match_stats ORDER BY user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all user stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := make([]UserMatchStats, 0)
+	for rows.Next() {
+		var s UserMatchStats
+		if err := rows.Scan(&s.UserID, &s.MatchCount, &s.LastMatchAt); err != nil {
+			return nil, fmt.Errorf("failed to get all user stats: %w", err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// CreateChatSession 创建聊天会话
+func (ss *SQLiteStorage) CreateChatSession(roomID string, users []string) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to create chat session: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO chat_sessions (room_id, start_at, end_at, active) VALUES (?, ?, NULL, 1)
+		ON CONFLICT(room_id) DO UPDATE SET start_at = excluded.start_at, end_at = NULL, active = 1`,
+		roomID, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create chat session: %w", err)
+	}
+
+	// 为所有用户添加房间记录
+	for _, userID := range users {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO session_users (room_id, user_id) VALUES (?, ?)`, roomID, userID); err != nil {
+			return fmt.Errorf("failed to add session user: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetRoomMembers 获取房间成员
+func (ss *SQLiteStorage) GetRoomMembers(roomID string) ([]string, error) {
+	rows, err := ss.db.Query(`SELECT user_id FROM session_users WHERE room_id = ? ORDER BY user_id`, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room members: %w", err)
+	}
+	defer rows.Close()
+
+	members := make([]string, 0, 2)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("failed to get room members: %w", err)
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+// EndChatSession 结束聊天会话
+func (ss *SQLiteStorage) EndChatSession(roomID string) error {
+	_, err := ss.db.Exec(
+		`UPDATE chat_sessions SET end_at = ?, active = 0 WHERE room_id = ?`,
+		time.Now().UnixNano(), roomID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to end chat session: %w", err)
+	}
+	return nil
+}
+
+// BlockUser 屏蔽用户
+func (ss *SQLiteStorage) BlockUser(userID, blockedID string) error {
+	_, err := ss.db.Exec(
+		`INSERT OR IGNORE INTO user_blocks (user_id, blocked_id, created_at) VALUES (?, ?, ?)`,
+		userID, blockedID, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to block user: %w", err)
+	}
+	return nil
+}
+
+// GetBlockedUsers 获取用户屏蔽的用户列表
+func (ss *SQLiteStorage) GetBlockedUsers(userID string) ([]string, error) {
+	rows, err := ss.db.Query(`SELECT blocked_id FROM user_blocks WHERE user_id = ? ORDER BY blocked_id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blocked users: %w", err)
+	}
+	defer rows.Close()
+
+	blocked := make([]string, 0)
+	for rows.Next() {
+		var blockedID string
+		if err := rows.Scan(&blockedID); err != nil {
+			return nil, fmt.Errorf("failed to get blocked users: %w", err)
+		}
+		blocked = append(blocked, blockedID)
+	}
+	return blocked, rows.Err()
+}
+
+// GetBlockedBy 获取屏蔽了该用户的用户列表
+func (ss *SQLiteStorage) GetBlockedBy(userID string) ([]string, error) {
+	rows, err := ss.db.Query(`SELECT user_id FROM user_blocks WHERE blocked_id = ? ORDER BY user_id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blockers: %w", err)
+	}
+	defer rows.Close()
+
+	blockers := make([]string, 0)
+	for rows.Next() {
+		var blockerID string
+		if err := rows.Scan(&blockerID); err != nil {
+			return nil, fmt.Errorf("failed to get blockers: %w", err)
+		}
+		blockers = append(blockers, blockerID)
+	}
+	return blockers, rows.Err()
+}
+
+// SaveRoomSummary 保存房间的对话摘要
+func (ss *SQLiteStorage) SaveRoomSummary(summary RoomSummary) error {
+	_, err := ss.db.Exec(
+		`INSERT INTO room_summaries (room_id, summary, up_to, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(room_id) DO UPDATE SET summary = excluded.summary, up_to = excluded.up_to, updated_at = excluded.updated_at`,
+		summary.RoomID, summary.Summary, summary.UpTo.UnixNano(), summary.UpdatedAt.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save room summary: %w", err)
+	}
+	return nil
+}
+
+// GetRoomSummary 获取房间的对话摘要
+func (ss *SQLiteStorage) GetRoomSummary(roomID string) (*RoomSummary, error) {
+	var upTo, updatedAt int64
+	summary := RoomSummary{RoomID: roomID}
+	err := ss.db.QueryRow(
+		`SELECT summary, up_to, updated_at FROM room_summaries WHERE room_id = ?`, roomID,
+	).Scan(&summary.Summary, &upTo, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room summary: %w", err)
+	}
+	summary.UpTo = time.Unix(0, upTo)
+	summary.UpdatedAt = time.Unix(0, updatedAt)
+	return &summary, nil
+}
@@ -4,12 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 // Storage 存储接口
 type Storage interface {
 	// 聊天记录相关
 	SaveMessage(message Message) error
+	// SaveMessageDedup 保存带ClientID的消息，window内同一房间已保存过相同ClientID的消息时不再保存，
+	// 返回已保存的消息和true，客户端重发时据此得到相同的消息ID和时间戳
+	SaveMessageDedup(message Message, window time.Duration) (Message, bool, error)
 	GetChatHistory(roomID string, limit int) ([]Message, error)
 	GetUserChatRooms(userID string) ([]string, error)
 
@@ -21,17 +26,69 @@ type Storage interface {
 	// 房间相关
 	CreateChatSession(roomID string, users []string) error
 	EndChatSession(roomID string) error
+	// GetRoomMembers 获取创建会话时记录的房间成员，房间不存在时返回空列表
+	GetRoomMembers(roomID string) ([]string, error)
+
+	// 屏蔽相关
+	BlockUser(userID, blockedID string) error
+	GetBlockedUsers(userID string) ([]string, error)
+	// GetBlockedBy 获取屏蔽了该用户的用户列表
+	GetBlockedBy(userID string) ([]string, error)
+
+	// 消息回执相关，read同时表示已送达；聊天记录中返回消息的送达和已读时间。
+	// 只保存房间中其他用户发送的消息的回执，消息不在该房间中或由reader发送时不保存并返回false
+	SaveReceipt(roomID, messageID, reader string, status ReceiptStatus, at time.Time) (bool, error)
+
+	// AI对话摘要相关，房间没有摘要时返回nil
+	SaveRoomSummary(summary RoomSummary) error
+	GetRoomSummary(roomID string) (*RoomSummary, error)
+}
+
+// MessageQuerier 支持按房间、发送者和时间范围查询消息的存储（SQLite存储）
+type MessageQuerier interface {
+	QueryMessages(query MessageQuery) ([]Message, error)
 }
 
+// 聊天记录的默认保留时间
+const defaultHistoryTTL = 30 * 24 * time.Hour
+
+// saveReceiptScript 消息由其他用户发送时合并回执，已记录的时间不会被覆盖
+// KEYS: 发送者, 回执  ARGV: 消息ID, reader, 回执时间, 回执状态, 过期秒数
+var saveReceiptScript = redis.NewScript(`
+local sender = redis.call('HGET', KEYS[1], ARGV[1])
+if not sender or sender == ARGV[2] then
+	return 0
+end
+local data = redis.call('HGET', KEYS[2], ARGV[1])
+local receipt = {}
+if data then
+	receipt = cjson.decode(data)
+end
+if not receipt['delivered_at'] then
+	receipt['delivered_at'] = ARGV[3]
+end
+if ARGV[4] == 'read' and not receipt['read_at'] then
+	receipt['read_at'] = ARGV[3]
+end
+redis.call('HSET', KEYS[2], ARGV[1], cjson.encode(receipt))
+redis.call('EXPIRE', KEYS[2], ARGV[5])
+return 1
+`)
+
 // RedisStorage Redis存储实现
 type RedisStorage struct {
-	redis *RedisManager
+	redis      *RedisManager
+	historyTTL time.Duration // 聊天记录和房间信息的过期时间
 }
 
-// NewRedisStorage 创建Redis存储实例
-func NewRedisStorage(redisManager *RedisManager) Storage {
+// NewRedisStorage 创建Redis存储实例，historyTTL不大于0时使用默认的30天
+func NewRedisStorage(redisManager *RedisManager, historyTTL time.Duration) Storage {
+	if historyTTL <= 0 {
+		historyTTL = defaultHistoryTTL
+	}
 	return &RedisStorage{
-		redis: redisManager,
+		redis:      redisManager,
+		historyTTL: historyTTL,
 	}
 }
 
@@ -52,6 +109,34 @@ func (rs *RedisStorage) getRoomInfoKey(roomID string) string {
 	return fmt.Sprintf("room:info:%s", roomID)
 }
 
+func (rs *RedisStorage) getRoomMembersKey(roomID string) string {
+	return fmt.Sprintf("room:members:%s", roomID)
+}
+
+func (rs *RedisStorage) getBlockListKey(userID string) string {
+	return fmt.Sprintf("user:blocks:%s", userID)
+}
+
+func (rs *RedisStorage) getBlockedByKey(userID string) string {
+	return fmt.Sprintf("user:blocked_by:%s", userID)
+}
+
+func (rs *RedisStorage) getReceiptsKey(roomID string) string {
+	return fmt.Sprintf("chat:receipts:%s", roomID)
+}
+
+func (rs *RedisStorage) getClientMessageKey(roomID, clientID string) string {
+	return fmt.Sprintf("chat:client:%s:%s", roomID, clientID)
+}
+
+func (rs *RedisStorage) getSendersKey(roomID string) string {
+	return fmt.Sprintf("chat:senders:%s", roomID)
+}
+
+func (rs *RedisStorage) getRoomSummaryKey(roomID string) string {
+	return fmt.Sprintf("room:summary:%s", roomID)
+}
+
 // SaveMessage 保存消息到Redis
 func (rs *RedisStorage) SaveMessage(message Message) error {
 	if !rs.redis.IsConnected() {
@@ -76,13 +161,18 @@ func (rs *RedisStorage) SaveMessage(message Message) error {
 		return fmt.Errorf("failed to save message: %w", err)
 	}
 
-	// 设置过期时间 (30天)
-	rs.redis.client.Expire(rs.redis.ctx, chatKey, 30*24*time.Hour)
+	// 设置过期时间（storage.history_ttl，默认30天）
+	rs.redis.client.Expire(rs.redis.ctx, chatKey, rs.historyTTL)
+
+	// 记录消息的发送者，保存回执时据此校验
+	sendersKey := rs.getSendersKey(message.RoomID)
+	rs.redis.client.HSet(rs.redis.ctx, sendersKey, message.ID, message.From)
+	rs.redis.client.Expire(rs.redis.ctx, sendersKey, rs.historyTTL)
 
 	// 为发送者添加房间记录
 	userRoomsKey := rs.getUserRoomsKey(message.From)
 	rs.redis.client.SAdd(rs.redis.ctx, userRoomsKey, message.RoomID)
-	rs.redis.client.Expire(rs.redis.ctx, userRoomsKey, 30*24*time.Hour)
+	rs.redis.client.Expire(rs.redis.ctx, userRoomsKey, rs.historyTTL)
 
 	return nil
 }
@@ -103,10 +193,22 @@ func (rs *RedisStorage) GetChatHistory(roomID string, limit int) ([]Message, err
 		return nil, fmt.Errorf("failed to get chat history: %w", err)
 	}
 
+	// 读取房间的消息回执
+	receipts, err := rs.redis.client.HGetAll(rs.redis.ctx, rs.getReceiptsKey(roomID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message receipts: %w", err)
+	}
+
 	messages := make([]Message, 0, len(result))
 	for i := len(result) - 1; i >= 0; i-- { // 反向遍历以获得正确的时间顺序
 		var msg Message
 		if err := json.Unmarshal([]byte(result[i]), &msg); err == nil {
+			if data, ok := receipts[msg.ID]; ok {
+				var receipt messageReceipt
+				if err := json.Unmarshal([]byte(data), &receipt); err == nil {
+					msg.DeliveredAt, msg.ReadAt = receipt.DeliveredAt, receipt.ReadAt
+				}
+			}
 			messages = append(messages, msg)
 		}
 	}
@@ -114,6 +216,81 @@ func (rs *RedisStorage) GetChatHistory(roomID string, limit int) ([]Message, err
 	return messages, nil
 }
 
+// messageReceipt 消息的回执状态
+type messageReceipt struct {
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+}
+
+// apply 更新回执状态，已记录的时间不会被覆盖
+func (r *messageReceipt) apply(status ReceiptStatus, at time.Time) {
+	if r.DeliveredAt == nil && (status == ReceiptDelivered || status == ReceiptRead) {
+		r.DeliveredAt = &at
+	}
+	if r.ReadAt == nil && status == ReceiptRead {
+		r.ReadAt = &at
+	}
+}
+
+// SaveMessageDedup 用SETNX记录房间内的ClientID，window后过期；已存在时返回记录的消息
+func (rs *RedisStorage) SaveMessageDedup(message Message, window time.Duration) (Message, bool, error) {
+	if message.ClientID == "" {
+		return message, false, rs.SaveMessage(message)
+	}
+	if !rs.redis.IsConnected() {
+		return message, false, fmt.Errorf("Redis not connected")
+	}
+
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	msgData, err := json.Marshal(message)
+	if err != nil {
+		return message, false, fmt.Errorf("failed to serialize message: %w", err)
+	}
+
+	clientKey := rs.getClientMessageKey(message.RoomID, message.ClientID)
+	ok, err := rs.redis.client.SetNX(rs.redis.ctx, clientKey, msgData, window).Result()
+	if err != nil {
+		return message, false, fmt.Errorf("failed to dedupe message: %w", err)
+	}
+	if !ok {
+		data, err := rs.redis.client.Get(rs.redis.ctx, clientKey).Bytes()
+		if err != nil {
+			return message, false, fmt.Errorf("failed to get deduped message: %w", err)
+		}
+		var saved Message
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return message, false, fmt.Errorf("failed to parse deduped message: %w", err)
+		}
+		return saved, true, nil
+	}
+	if err := rs.SaveMessage(message); err != nil {
+		// 保存失败时释放ClientID，客户端重发时重新保存
+		rs.redis.client.Del(rs.redis.ctx, clientKey)
+		return message, false, err
+	}
+	return message, false, nil
+}
+
+// SaveReceipt 保存消息回执，与聊天记录使用相同的过期时间（校验发送者和合并回执在同一脚本中完成）
+func (rs *RedisStorage) SaveReceipt(roomID, messageID, reader string, status ReceiptStatus, at time.Time) (bool, error) {
+	if !rs.redis.IsConnected() {
+		return false, fmt.Errorf("Redis not connected")
+	}
+	if status != ReceiptDelivered && status != ReceiptRead {
+		return false, nil
+	}
+
+	keys := []string{rs.getSendersKey(roomID), rs.getReceiptsKey(roomID)}
+	saved, err := saveReceiptScript.Run(rs.redis.ctx, rs.redis.client, keys,
+		messageID, reader, at.Format(time.RFC3339Nano), string(status), int(rs.historyTTL.Seconds())).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to save message receipt: %w", err)
+	}
+	return saved == 1, nil
+}
+
 // GetUserChatRooms 获取用户参与的聊天室列表
 func (rs *RedisStorage) GetUserChatRooms(userID string) ([]string, error) {
 	if !rs.redis.IsConnected() {
@@ -245,18 +422,41 @@ func (rs *RedisStorage) CreateChatSession(roomID string, users []string) error {
 	}
 
 	// 设置过期时间
-	rs.redis.client.Expire(rs.redis.ctx, roomKey, 30*24*time.Hour)
+	rs.redis.client.Expire(rs.redis.ctx, roomKey, rs.historyTTL)
+
+	// 记录房间成员
+	membersKey := rs.getRoomMembersKey(roomID)
+	for _, userID := range users {
+		if err := rs.redis.client.SAdd(rs.redis.ctx, membersKey, userID).Err(); err != nil {
+			return fmt.Errorf("failed to save room members: %w", err)
+		}
+	}
+	rs.redis.client.Expire(rs.redis.ctx, membersKey, rs.historyTTL)
 
 	// 为所有用户添加房间记录
 	for _, userID := range users {
 		userRoomsKey := rs.getUserRoomsKey(userID)
 		rs.redis.client.SAdd(rs.redis.ctx, userRoomsKey, roomID)
-		rs.redis.client.Expire(rs.redis.ctx, userRoomsKey, 30*24*time.Hour)
+		rs.redis.client.Expire(rs.redis.ctx, userRoomsKey, rs.historyTTL)
 	}
 
 	return nil
 }
 
+// GetRoomMembers 获取房间成员
+func (rs *RedisStorage) GetRoomMembers(roomID string) ([]string, error) {
+	if !rs.redis.IsConnected() {
+		return nil, fmt.Errorf("Redis not connected")
+	}
+
+	members, err := rs.redis.client.SMembers(rs.redis.ctx, rs.getRoomMembersKey(roomID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room members: %w", err)
+	}
+
+	return members, nil
+}
+
 // EndChatSession 结束聊天会话
 func (rs *RedisStorage) EndChatSession(roomID string) error {
 	if !rs.redis.IsConnected() {
@@ -273,3 +473,83 @@ func (rs *RedisStorage) EndChatSession(roomID string) error {
 
 	return rs.redis.client.HMSet(rs.redis.ctx, roomKey, updates).Err()
 }
+
+// BlockUser 屏蔽用户（永久保存，不设置过期时间）
+func (rs *RedisStorage) BlockUser(userID, blockedID string) error {
+	if !rs.redis.IsConnected() {
+		return fmt.Errorf("Redis not connected")
+	}
+
+	// 同时记录反向索引，匹配时一次查询即可得到屏蔽了自己的用户
+	pipe := rs.redis.client.TxPipeline()
+	pipe.SAdd(rs.redis.ctx, rs.getBlockListKey(userID), blockedID)
+	pipe.SAdd(rs.redis.ctx, rs.getBlockedByKey(blockedID), userID)
+	if _, err := pipe.Exec(rs.redis.ctx); err != nil {
+		return fmt.Errorf("failed to block user: %w", err)
+	}
+	return nil
+}
+
+// GetBlockedUsers 获取用户屏蔽的用户列表
+func (rs *RedisStorage) GetBlockedUsers(userID string) ([]string, error) {
+	if !rs.redis.IsConnected() {
+		return nil, fmt.Errorf("Redis not connected")
+	}
+
+	blocked, err := rs.redis.client.SMembers(rs.redis.ctx, rs.getBlockListKey(userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blocked users: %w", err)
+	}
+	return blocked, nil
+}
+
+// GetBlockedBy 获取屏蔽了该用户的用户列表
+func (rs *RedisStorage) GetBlockedBy(userID string) ([]string, error) {
+	if !rs.redis.IsConnected() {
+		return nil, fmt.Errorf("Redis not connected")
+	}
+
+	blockers, err := rs.redis.client.SMembers(rs.redis.ctx, rs.getBlockedByKey(userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blockers: %w", err)
+	}
+	return blockers, nil
+}
+
+// SaveRoomSummary 保存房间的对话摘要，与聊天记录使用相同的过期时间
+func (rs *RedisStorage) SaveRoomSummary(summary RoomSummary) error {
+	if !rs.redis.IsConnected() {
+		return fmt.Errorf("Redis not connected")
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to serialize room summary: %w", err)
+	}
+	err = rs.redis.client.Set(rs.redis.ctx, rs.getRoomSummaryKey(summary.RoomID), data, rs.historyTTL).Err()
+	if err != nil {
+		return fmt.Errorf("failed to save room summary: %w", err)
+	}
+	return nil
+}
+
+// GetRoomSummary 获取房间的对话摘要
+func (rs *RedisStorage) GetRoomSummary(roomID string) (*RoomSummary, error) {
+	if !rs.redis.IsConnected() {
+		return nil, fmt.Errorf("Redis not connected")
+	}
+
+	data, err := rs.redis.client.Get(rs.redis.ctx, rs.getRoomSummaryKey(roomID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room summary: %w", err)
+	}
+
+	var summary RoomSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, fmt.Errorf("failed to parse room summary: %w", err)
+	}
+	return &summary, nil
+}
@@ -3,9 +3,9 @@ package handler
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 // UserMatchStats 用户匹配统计
@@ -24,6 +24,23 @@ type ChatHistory struct {
 	EndAt    time.Time `json:"end_at"`   // 聊天结束时间
 }
 
+// ChatSession 聊天会话记录
+type ChatSession struct {
+	RoomID  string    `json:"room_id"`          // 房间ID
+	Users   []string  `json:"users"`            // 参与用户列表
+	StartAt time.Time `json:"start_at"`         // 会话开始时间
+	EndAt   time.Time `json:"end_at,omitempty"` // 会话结束时间
+	Active  bool      `json:"active"`           // 会话是否进行中
+}
+
+// RoomSummary AI房间的对话摘要，概括UpTo（含）之前的聊天记录
+type RoomSummary struct {
+	RoomID    string    `json:"room_id"`
+	Summary   string    `json:"summary"`
+	UpTo      time.Time `json:"up_to"`      // 已概括的最后一条消息的时间
+	UpdatedAt time.Time `json:"updated_at"` // 摘要更新时间
+}
+
 // GenerateMessageID 生成唯一消息ID
 func GenerateMessageID() string {
 	bytes := make([]byte, 8)
@@ -31,6 +48,13 @@ func GenerateMessageID() string {
 	return hex.EncodeToString(bytes)
 }
 
+// GenerateRoomID 生成不可猜测的房间ID，房间ID不包含成员信息，成员关系以RoomManager和存储中的记录为准
+func GenerateRoomID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return "r_" + hex.EncodeToString(bytes)
+}
+
 // GenerateAIUserID 生成AI用户ID
 func GenerateAIUserID() string {
 	bytes := make([]byte, 6)
@@ -38,6 +62,13 @@ func GenerateAIUserID() string {
 	return "ai_" + hex.EncodeToString(bytes)
 }
 
+// GenerateResumeToken 生成恢复会话的令牌
+func GenerateResumeToken() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
 // IsAIUser 检查是否为AI用户
 func IsAIUser(userID string) bool {
 	return len(userID) > 3 && userID[:3] == "ai_"
@@ -65,26 +96,68 @@ type User struct {
 	ID    string
 	Type  UserType // 用户类型
 	State UserState
-	Conn  *websocket.Conn // WS连接（聊天时使用）
+
+	conn atomic.Pointer[WSConn] // WS连接（聊天时使用），断线或连接在其他实例上时为nil
+
+	// 断线重连相关，由RoomManager加锁访问
+	resumeToken    string      // 本实例上的连接对应的令牌，每次连接时重新生成；共享的会话见ResumeSession
+	disconnectedAt time.Time   // 本实例上的连接断开的时间，宽限期内不为零
+	graceTimer     *time.Timer // 宽限期结束后离开房间
+}
+
+// Conn 返回用户当前的WS连接，未连接时为nil
+func (u *User) Conn() *WSConn {
+	return u.conn.Load()
+}
+
+// Send 将消息加入用户WS连接的发送队列，并发安全
+func (u *User) Send(msg Message) error {
+	conn := u.conn.Load()
+	if conn == nil {
+		return errConnClosed
+	}
+	return conn.Send(msg)
 }
 
 // MatchRequest 匹配请求
 type MatchRequest struct {
-	UserID string `json:"user_id"`
+	UserID      string   `json:"user_id,omitempty"`      // 由令牌中的用户ID设置，忽略请求中的值
+	Tags        []string `json:"tags,omitempty"`         // 可选，兴趣标签
+	Language    string   `json:"language,omitempty"`     // 可选，偏好语言
+	AvoidRecent bool     `json:"avoid_recent,omitempty"` // 可选，不与最近匹配过的用户再次匹配
+	AIFallback  *bool    `json:"ai_fallback,omitempty"`  // 可选，是否允许超时后与AI匹配，不设置时由匹配策略决定
+	Persona     string   `json:"persona,omitempty"`      // 可选，与AI匹配时偏好的AI人设
 }
 
 // MatchResponse 匹配响应
 type MatchResponse struct {
-	Matched bool   `json:"matched"`
-	RoomID  string `json:"room_id"`
-	Partner string `json:"partner_id"` // 可选，返回对方ID
+	Matched    bool         `json:"matched"`
+	RoomID     string       `json:"room_id"`
+	Partner    string       `json:"partner_id"`            // 可选，返回对方ID
+	CommonTags []string     `json:"common_tags,omitempty"` // 可选，双方共同的兴趣标签
+	Persona    *PersonaInfo `json:"persona,omitempty"`     // 与AI匹配时的AI人设
+}
+
+// BlockRequest 屏蔽聊天对象请求
+type BlockRequest struct {
+	UserID string `json:"user_id,omitempty"` // 由令牌中的用户ID设置，忽略请求中的值
+	RoomID string `json:"room_id"`
 }
 
 // Room 聊天室
 type Room struct {
 	ID      string
-	Users   map[string]*User
+	Users   map[string]*User // 房间创建后通过user/users/deleteUser并发安全地访问
 	MsgChan chan Message
+
+	usersMu sync.RWMutex // 保护Users；不使用mu，因为deliver持有mu时会阻塞等待消息循环
+
+	mu          sync.Mutex
+	members     []string // 房间成员，创建后不变（Users中的用户离开后会被移除）
+	closed      bool     // MsgChan是否已关闭
+	withAI      bool     // 是否为AI房间（只在本实例内处理）
+	persona     *Persona // AI房间使用的人设
+	unsubscribe func()   // 取消订阅房间事件
 }
 
 // Message 消息结构体
@@ -92,7 +165,69 @@ type Message struct {
 	ID        string    `json:"id,omitempty"`        // 消息唯一ID
 	From      string    `json:"from"`                // 发送者用户ID
 	Content   string    `json:"content"`             // 消息内容
-	Type      string    `json:"type"`                // text/image/audio/video
+	Type      string    `json:"type"`                // text/image/audio/video，临时事件为event，回执为receipt
 	Timestamp time.Time `json:"timestamp,omitempty"` // 消息时间戳
 	RoomID    string    `json:"room_id,omitempty"`   // 聊天室ID
+	Stream    string    `json:"stream,omitempty"`    // 流式AI回复帧：chunk/done/cancelled，普通消息为空
+	Event     EventType `json:"event,omitempty"`     // 临时事件类型，Type为event时有效
+
+	ClientID    string        `json:"client_id,omitempty"`    // 客户端生成的消息ID，重发时使用相同的值，服务端在去重窗口内只保存一次；sent回执中原样返回
+	Receipt     ReceiptStatus `json:"receipt,omitempty"`      // 回执状态，Type为receipt时有效，此时ID为被回执的消息ID
+	DeliveredAt *time.Time    `json:"delivered_at,omitempty"` // 对方收到消息的时间（聊天记录中返回）
+	ReadAt      *time.Time    `json:"read_at,omitempty"`      // 对方已读消息的时间（聊天记录中返回）
+
+	ResumeToken string `json:"resume_token,omitempty"` // 恢复会话的令牌，Type为session时有效
+	Replay      bool   `json:"replay,omitempty"`       // 断线重连后补发的消息
+}
+
+// MessageTypeSession 会话消息类型：连接建立后下发恢复会话的令牌，恢复失败时令牌为空
+const MessageTypeSession = "session"
+
+// ResumeRequest 断线重连时恢复会话的参数
+type ResumeRequest struct {
+	Token  string // 上次连接时下发的恢复令牌
+	LastID string // 客户端收到的最后一条消息ID，补发之后的消息
+}
+
+// MessageTypeReceipt 消息回执类型：只在房间内转发给消息发送者，回执状态保存在聊天记录中
+const MessageTypeReceipt = "receipt"
+
+// ReceiptStatus 消息回执状态
+type ReceiptStatus string
+
+const (
+	ReceiptSent      ReceiptStatus = "sent"      // 服务端已保存消息（只发给发送者，携带服务端生成的消息ID和时间戳）
+	ReceiptDelivered ReceiptStatus = "delivered" // 对方客户端已收到
+	ReceiptRead      ReceiptStatus = "read"      // 对方已读
+)
+
+// 流式AI回复帧，同一条回复的所有帧使用相同的消息ID
+const (
+	StreamChunk     = "chunk"     // 增量内容
+	StreamDone      = "done"      // 结束帧，携带完整内容
+	StreamCancelled = "cancelled" // 回复被取消（用户再次发言），客户端应丢弃已收到的内容
+)
+
+// MessageTypeEvent 临时事件消息类型：只在房间内转发，不保存到聊天记录，也不触发AI回复
+const MessageTypeEvent = "event"
+
+// EventType 临时事件类型
+type EventType string
+
+const (
+	EventTyping        EventType = "typing"         // 正在输入
+	EventStoppedTyping EventType = "stopped_typing" // 停止输入
+	EventOnline        EventType = "online"         // 在线（连接房间或回到页面）
+	EventAway          EventType = "away"           // 暂时离开（页面切到后台）
+	EventFocus         EventType = "focus"          // 聊天窗口获得焦点
+	EventBlur          EventType = "blur"           // 聊天窗口失去焦点
+)
+
+// Valid 是否为已知的事件类型
+func (e EventType) Valid() bool {
+	switch e {
+	case EventTyping, EventStoppedTyping, EventOnline, EventAway, EventFocus, EventBlur:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WS连接保活和发送队列参数
+const (
+	wsWriteWait  = 10 * time.Second    // 单次写入的超时时间
+	wsPongWait   = 60 * time.Second    // 超过该时间没有收到pong或消息时认为连接已断开
+	wsPingPeriod = wsPongWait * 9 / 10 // 发送ping的间隔，需小于wsPongWait
+	wsSendBuffer = 256                 // 每个连接的发送队列长度
+)
+
+// CloseNotRoomMember 用户不是房间成员时的WS关闭码（应用自定义范围4000-4999，对应HTTP 403）
+const CloseNotRoomMember = 4403
+
+var (
+	errConnClosed   = errors.New("connection closed")
+	errSlowConsumer = errors.New("send queue full")
+)
+
+// WSConn 带发送队列的WS连接：消息加入队列后由写协程逐条发送，并定时发送ping保活。
+// 队列已满（客户端接收过慢）时丢弃临时消息（临时事件、流式增量帧），其他消息则断开连接，
+// 客户端重连后通过恢复会话补发消息，避免一个卡住的连接阻塞整个房间的广播
+type WSConn struct {
+	conn *websocket.Conn
+	send chan Message
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWSConn 包装WS连接，设置读超时和pong处理并启动写协程
+func NewWSConn(conn *websocket.Conn) *WSConn {
+	c := &WSConn{
+		conn: conn,
+		send: make(chan Message, wsSendBuffer),
+		done: make(chan struct{}),
+	}
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go c.writeLoop()
+	return c
+}
+
+// ReadJSON 读取一条消息，收到消息后延长读超时（只由读协程调用）
+func (c *WSConn) ReadJSON(v interface{}) error {
+	if err := c.conn.ReadJSON(v); err != nil {
+		return err
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+}
+
+// Send 将消息加入发送队列，不会阻塞
+func (c *WSConn) Send(msg Message) error {
+	select {
+	case <-c.done:
+		return errConnClosed
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return nil
+	default:
+	}
+
+	if msg.Type == MessageTypeEvent || msg.Stream == StreamChunk {
+		return errSlowConsumer
+	}
+	log.Printf("Closing slow connection %s: send queue full", c.conn.RemoteAddr())
+	c.Close()
+	return errSlowConsumer
+}
+
+// Close 关闭连接，队列中未发送的消息被丢弃
+func (c *WSConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// closeWithCode 在建立WSConn之前以指定的关闭码关闭连接
+func closeWithCode(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+	conn.Close()
+}
+
+// writeLoop 逐条发送队列中的消息并定时发送ping，写入失败时关闭连接
+func (c *WSConn) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				log.Printf("Error writing to %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -8,34 +8,112 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/toujourser/chat-matcher/config"
 	"github.com/toujourser/chat-matcher/handler"
 	"github.com/toujourser/chat-matcher/middlewares"
 )
 
 func main() {
-	// 配置日志输出到文件
-	setupLogger()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
 
-	// 初始化Redis连接
-	redisConfig := handler.RedisConfig{
-		Addr:     "localhost:6379", // 可以通过环境变量REDIS_ADDR覆盖
-		Password: "",               // 可以通过环境变量REDIS_PASSWORD覆盖
-		DB:       0,                // 使用默认数据库
+	// 配置日志输出到文件
+	setupLogger(cfg.Server.LogDir)
+
+	// Redis连接按需创建（存储或匹配队列使用Redis时）
+	var redisManager *handler.RedisManager
+	getRedis := func() *handler.RedisManager {
+		if redisManager == nil {
+			redisManager = handler.NewRedisManager(handler.RedisConfig{
+				Addr:     cfg.Redis.Addr,
+				Password: cfg.Redis.Password,
+				DB:       cfg.Redis.DB,
+			})
+		}
+		return redisManager
+	}
+	defer func() {
+		if redisManager != nil {
+			redisManager.Close()
+		}
+	}()
+
+	// 创建存储实例（storage.type：redis/memory/sqlite）
+	var storage handler.Storage
+	switch cfg.Storage.Type {
+	case "memory":
+		storage = handler.NewMemoryStorage(cfg.Storage.MemoryMaxMessages)
+		log.Println("Using in-memory storage")
+	case "sqlite":
+		sqliteStorage, err := handler.NewSQLiteStorage(cfg.Storage.SQLiteDSN)
+		if err != nil {
+			log.Fatalf("Failed to initialize SQLite storage: %v", err)
+		}
+		defer sqliteStorage.Close()
+		storage = sqliteStorage
+		log.Println("Using SQLite storage")
+	case "redis":
+		// 创建Redis存储实例
+		storage = handler.NewRedisStorage(getRedis(), cfg.Storage.HistoryTTL)
 	}
 
-	redisManager := handler.NewRedisManager(redisConfig)
-	defer redisManager.Close()
+	// 创建匹配队列（match.queue：memory/redis，多实例部署时使用redis）
+	var queue handler.MatchQueue
+	switch cfg.Match.Queue {
+	case "memory":
+		queue = handler.NewMemoryMatchQueue()
+	case "redis":
+		queue = handler.NewRedisMatchQueue(getRedis())
+		log.Println("Using Redis match queue")
+	}
 
-	// 创建Redis存储实例
-	storage := handler.NewRedisStorage(redisManager)
+	// 创建房间消息传输层（room.transport：local/redis，多实例部署时使用redis）
+	var transport handler.RoomTransport
+	switch cfg.Room.Transport {
+	case "local":
+		transport = handler.NewLocalRoomTransport()
+	case "redis":
+		transport = handler.NewRedisRoomTransport(getRedis())
+		log.Println("Using Redis room transport")
+	}
 
-	// 初始化处理器
-	handler.InitializeHandlers(storage)
+	// AI匹配策略和人设（加载配置时已生成）
+	fallback := cfg.FallbackPolicy()
+	if !fallback.Enabled {
+		log.Println("AI fallback disabled, matching humans only")
+	}
+	personas := cfg.Personas()
+	log.Printf("Loaded %d AI personas, default: %s", len(personas.List()), personas.Pick("").Name)
 
-	port := ":9093"
+	// 用户令牌签发器
+	authenticator := handler.NewAuthenticator(cfg.Auth.Secret, cfg.Auth.AdminKey, cfg.Auth.TokenTTL)
 
-	// 创建Gin引擎
-	r := gin.Default()
+	// 初始化处理器
+	handler.InitializeHandlers(storage, queue, transport, authenticator, handler.MatcherConfig{
+		AI: handler.AIConfig{
+			Provider: cfg.AI.Provider,
+			APIKey:   cfg.AI.APIKey,
+			Model:    cfg.AI.Model,
+			BaseURL:  cfg.AI.BaseURL,
+			Script:   cfg.AI.Script,
+
+			ContextBudget:    cfg.AI.ContextBudget,
+			SummaryThreshold: cfg.AI.SummaryThreshold,
+		},
+		Fallback: fallback,
+	}, handler.RoomConfig{
+		AIGreetingDelay: cfg.Room.AIGreetingDelay,
+		AIReplyTimeout:  cfg.Room.AIReplyTimeout,
+		DedupeWindow:    cfg.Room.DedupeWindow,
+		ResumeGrace:     cfg.Room.ResumeGrace,
+		Personas:        personas,
+	})
+
+	// 创建Gin引擎（请求日志隐藏查询参数中的令牌）
+	r := gin.New()
+	r.Use(middlewares.Logger(), gin.Recovery())
 
 	// 添加CORS中间件
 	r.Use(middlewares.CORS())
@@ -43,22 +121,35 @@ func main() {
 	// 注册API路由
 	api := r.Group("/api")
 	{
-		api.POST("/match", handler.MatchHandle)
-		api.GET("/ws", handler.WSHandle)
-		api.GET("/chat/history", handler.ChatHistoryHandle)
-		api.GET("/user/stats", handler.UserStatsHandle)
-		api.GET("/user/rooms", handler.UserRoomsHandle)
+		api.POST("/auth/anonymous", handler.AnonymousSessionHandle)
+		api.POST("/auth/admin", handler.AdminSessionHandle)
+		api.GET("/personas", handler.PersonasHandle)
+	}
+
+	// 需要令牌的API路由，用户ID取自令牌
+	authed := api.Group("", middlewares.Auth(authenticator.Verify))
+	{
+		authed.POST("/match", handler.MatchHandle)
+		authed.GET("/match/:ticket", handler.MatchTicketHandle)
+		authed.DELETE("/match/:ticket", handler.CancelMatchHandle)
+		authed.GET("/match/:ticket/events", handler.MatchEventsHandle)
+		authed.GET("/lobby/events", handler.LobbyEventsHandle)
+		authed.GET("/ws", handler.WSHandle)
+		authed.POST("/room/block", handler.BlockPartnerHandle)
+		authed.GET("/chat/history", handler.ChatHistoryHandle)
+		authed.GET("/chat/messages", handler.MessageArchiveHandle)
+		authed.GET("/user/stats", handler.UserStatsHandle)
+		authed.GET("/user/rooms", handler.UserRoomsHandle)
 	}
 
 	// 静态文件服务
-	r.Static("/static", "./static")
-	log.Fatal(r.Run(port))
+	r.Static("/static", cfg.Server.StaticDir)
+	log.Fatal(r.Run(cfg.Server.Addr))
 }
 
 // setupLogger 配置日志输出到文件
-func setupLogger() {
-	// 创建 logs 目录
-	logsDir := "logs"
+func setupLogger(logsDir string) {
+	// 创建日志目录
 	if err := os.MkdirAll(logsDir, 0755); err != nil {
 		log.Printf("Failed to create logs directory: %v", err)
 		return
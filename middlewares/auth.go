@@ -0,0 +1,51 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 认证通过的用户ID和角色在gin.Context中的键
+const (
+	userIDKey = "auth_user_id"
+	roleKey   = "auth_role"
+)
+
+// RoleAdmin 管理员角色，可以访问其他用户的数据
+const RoleAdmin = "admin"
+
+// Auth 校验请求携带的令牌，通过后将令牌中的用户ID和角色保存到上下文，之后用UserID和IsAdmin读取。
+// 令牌放在 Authorization: Bearer <token> 请求头中，WebSocket和SSE等无法设置请求头的连接使用token查询参数
+func Auth(verify func(token string) (userID, role string, err error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			token = c.Query("token")
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
+			return
+		}
+
+		userID, role, err := verify(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(userIDKey, userID)
+		c.Set(roleKey, role)
+		c.Next()
+	}
+}
+
+// UserID 返回认证通过的用户ID，未经过Auth中间件时为空
+func UserID(c *gin.Context) string {
+	return c.GetString(userIDKey)
+}
+
+// IsAdmin 认证通过的用户是否为管理员
+func IsAdmin(c *gin.Context) bool {
+	return c.GetString(roleKey) == RoleAdmin
+}
@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logger 请求日志，格式与gin默认日志相同，但隐藏查询参数中的令牌（WebSocket和SSE通过token参数传递令牌）
+func Logger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		var statusColor, methodColor, resetColor string
+		if param.IsOutputColor() {
+			statusColor = param.StatusCodeColor()
+			methodColor = param.MethodColor()
+			resetColor = param.ResetColor()
+		}
+
+		if param.Latency > time.Minute {
+			param.Latency = param.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, param.StatusCode, resetColor,
+			param.Latency,
+			param.ClientIP,
+			methodColor, param.Method, resetColor,
+			redactToken(param.Path),
+			param.ErrorMessage,
+		)
+	})
+}
+
+// redactToken 将请求路径中token查询参数的值替换为REDACTED
+func redactToken(path string) string {
+	base, rawQuery, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// 无法解析时不输出查询参数
+		return base
+	}
+	if !query.Has("token") {
+		return path
+	}
+	query.Set("token", "REDACTED")
+	return base + "?" + query.Encode()
+}